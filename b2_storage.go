@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -17,10 +20,21 @@ type B2Storage struct {
 	client     *b2.Client
 	bucket     *b2.Bucket
 	config     Config
+	auth       *b2Authorization // 原生API授权信息（按需获取）
+	resumer    *UploadResumer   // 大文件续传记录，为空表示不续传
+	encryptor  *Encryptor       // 客户端加密，为空表示不加密
+	compressor *Compressor      // 上传前压缩，为空表示不压缩
 }
 
-// NewB2Storage 创建新的B2存储实例
-func NewB2Storage(config Config) (*B2Storage, error) {
+var (
+	_ Storage          = (*B2Storage)(nil)
+	_ ResumableStorage = (*B2Storage)(nil)
+	_ BlobStorage      = (*B2Storage)(nil)
+	_ OptionUploader   = (*B2Storage)(nil)
+)
+
+// NewB2Storage 创建新的B2存储实例，encryptor 为空时不加密，compressor 为空时不压缩
+func NewB2Storage(config Config, encryptor *Encryptor, compressor *Compressor) (*B2Storage, error) {
 	ctx := context.Background()
 	
 	// 连接到Backblaze B2
@@ -36,21 +50,28 @@ func NewB2Storage(config Config) (*B2Storage, error) {
 	}
 	
 	return &B2Storage{
-		client: client,
-		bucket: bucket,
-		config: config,
+		client:    client,
+		bucket:    bucket,
+		config:    config,
+		encryptor:  encryptor,
+		compressor: compressor,
 	}, nil
 }
 
 // UploadFile 上传文件到B2
 func (b *B2Storage) UploadFile(localPath, remotePath, checksum string) error {
+	return b.UploadFileWithOptions(localPath, remotePath, checksum, UploadOptions{})
+}
+
+// UploadFileWithOptions 按选项上传文件，Force 时不检查云端是否已存在相同文件
+func (b *B2Storage) UploadFileWithOptions(localPath, remotePath, checksum string, opts UploadOptions) error {
 	ctx := context.Background()
 	
 	// 检查云端是否已存在相同文件
-	remoteObj := b.bucket.Object(b.config.BackupPrefix + remotePath)
+	remoteObj := b.bucket.Object(b.objectName(remotePath))
 	
 	// 尝试获取远程文件信息
-	if attrs, err := remoteObj.Attrs(ctx); err == nil {
+	if attrs, err := remoteObj.Attrs(ctx); err == nil && !opts.Force {
 		// 如果远程文件存在，检查是否需要上传
 		log.Printf("File %s already exists in B2, checking if update is needed", remotePath)
 		
@@ -62,16 +83,16 @@ func (b *B2Storage) UploadFile(localPath, remotePath, checksum string) error {
 			// 完整策略：使用元数据文件进行详细检查
 			if b.config.EnableMetadataCheck {
 				if metadata, err := b.getFileMetadata(remotePath); err == nil {
-					if storedChecksum, ok := metadata["checksum"].(string); ok && storedChecksum == checksum {
+					if storedChecksum, ok := metadata["checksum"].(string); ok && storedChecksum == b.encryptor.ChecksumTag(checksum) {
 						log.Printf("File %s has same checksum (full check), skipping upload", remotePath)
 						shouldSkip = true
 					}
 				}
 			}
 		case "basic":
-			// 基本策略：只进行大小比较，不创建元数据文件
-			if localInfo, err := os.Stat(localPath); err == nil {
-				if localInfo.Size() == attrs.Size {
+			// 基本策略：只进行大小比较，不创建元数据文件；压缩文件的大小与原文件无关，不能比较
+			if localInfo, err := os.Stat(localPath); err == nil && attrs.Info[compressionInfoKey] == "" {
+				if b.encryptor.UploadSize(localInfo.Size()) == attrs.Size {
 					log.Printf("File %s has same size (basic check), skipping upload", remotePath)
 					shouldSkip = true
 				}
@@ -81,8 +102,8 @@ func (b *B2Storage) UploadFile(localPath, remotePath, checksum string) error {
 			log.Printf("File %s will be uploaded (no duplicate check)", remotePath)
 		default:
 			// 默认使用基本策略
-			if localInfo, err := os.Stat(localPath); err == nil {
-				if localInfo.Size() == attrs.Size {
+			if localInfo, err := os.Stat(localPath); err == nil && attrs.Info[compressionInfoKey] == "" {
+				if b.encryptor.UploadSize(localInfo.Size()) == attrs.Size {
 					log.Printf("File %s has same size (default check), skipping upload", remotePath)
 					shouldSkip = true
 				}
@@ -100,20 +121,58 @@ func (b *B2Storage) UploadFile(localPath, remotePath, checksum string) error {
 	}
 	defer file.Close()
 
-	// 创建对象
-	obj := b.bucket.Object(b.config.BackupPrefix + remotePath)
+	localInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 启用压缩和加密时先压缩再加密
+	compressed, err := b.compressor.Compress(file, remotePath, localInfo.Size())
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	size := b.encryptor.UploadSize(compressed.Size)
 	
-	// 创建writer
-	w := obj.NewWriter(ctx)
+	// 创建对象
+	obj := b.bucket.Object(b.objectName(remotePath))
 	
-	// 复制文件内容
-	if _, err := io.Copy(w, file); err != nil {
-		w.Close()
-		return err
+	// 在文件信息中记录压缩算法和加密参数
+	info := make(map[string]string)
+	for key, value := range opts.Info {
+		info[key] = value
+	}
+	if params := b.encryptor.Params(); params != "" {
+		info[encryptionInfoKey] = params
+	}
+	if compressed.Algorithm != "" {
+		info[compressionInfoKey] = compressed.Algorithm
 	}
 	
-	if err := w.Close(); err != nil {
-		return err
+	// 创建writer，超过分片大小的文件会自动使用大文件分片上传
+	// 源文件修改时间记录为 src_last_modified_millis，恢复和重建本地状态时使用
+	w := obj.NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{
+		ContentType:  "application/octet-stream",
+		Info:         info,
+		LastModified: localInfo.ModTime(),
+	}))
+	w.ChunkSize, w.ConcurrentUploads = uploadPartSettings(b.config, size)
+	
+	if size > int64(w.ChunkSize) {
+		if err := b.uploadLargeFile(w, compressed, remotePath, checksum, size, localInfo.ModTime()); err != nil {
+			return err
+		}
+	} else {
+		// 复制文件内容
+		content, _ := b.encryptor.UploadReader(compressed, compressed.Size)
+		if _, err := io.Copy(w, content); err != nil {
+			w.Close()
+			return err
+		}
+		
+		if err := w.Close(); err != nil {
+			return err
+		}
 	}
 	
 	// 根据策略决定是否存储元数据
@@ -124,7 +183,7 @@ func (b *B2Storage) UploadFile(localPath, remotePath, checksum string) error {
 			log.Printf("Warning: Could not get file info for metadata: %v", err)
 		} else {
 			// 存储文件元数据
-			if err := b.storeFileMetadata(remotePath, checksum, fileInfo.Size(), fileInfo.ModTime()); err != nil {
+			if err := b.storeFileMetadata(remotePath, b.encryptor.ChecksumTag(checksum), fileInfo.Size(), fileInfo.ModTime()); err != nil {
 				log.Printf("Warning: Could not store file metadata: %v", err)
 				// 不返回错误，因为文件上传成功了
 			}
@@ -134,46 +193,277 @@ func (b *B2Storage) UploadFile(localPath, remotePath, checksum string) error {
 	return nil
 }
 
+// blazer续传时远程分片与本地内容不一致的错误信息
+const b2ResumeMismatch = "chunks don't match"
+
+// 分片上传大文件，启用续传时记录未完成的上传以便下次运行继续
+// 启用加密时续传使用之前记录的文件随机数，重新加密得到的分片才能与已上传的一致
+func (b *B2Storage) uploadLargeFile(w *b2.Writer, compressed *compressedUpload, remotePath, checksum string, size int64, modTime time.Time) error {
+	name := b.objectName(remotePath)
+	parts := uploadPartCount(size, w.ChunkSize)
+	fileNonce := b.encryptor.NewFileNonce()
+	
+	if b.resumer != nil {
+		resumed, obsolete := b.resumer.Begin(remotePath, checksum, size, modTime, w.ChunkSize, fileNonce)
+		if obsolete != nil {
+			if err := b.CancelUnfinishedUpload(remotePath, obsolete.FileID); err != nil {
+				log.Printf("Warning: Could not cancel previous unfinished upload of %s: %v", remotePath, err)
+			}
+		}
+		if resumed != nil {
+			resume, err := b.selectUnfinishedUpload(name, resumed.FileID)
+			if err != nil {
+				log.Printf("Warning: Could not look up unfinished upload of %s, starting over: %v", remotePath, err)
+			}
+			w.Resume = resume
+			fileNonce = resumed.FileNonce
+		}
+	}
+	content, _ := b.encryptor.UploadReaderWithNonce(compressed, compressed.Size, fileNonce)
+	
+	log.Printf("Uploading %s as large file: %d parts of %d MB, %d concurrent",
+		remotePath, parts, w.ChunkSize/1000/1000, w.ConcurrentUploads)
+	progress := b.trackUploadProgress(name, parts)
+	defer progress.stop()
+	
+	// 续传时blazer按SHA1比对远程已有的分片，内容不一致时返回错误
+	_, err := io.Copy(w, content)
+	if err != nil {
+		w.Close()
+	} else {
+		err = w.Close()
+	}
+	
+	if err != nil {
+		// 远程分片与本地内容不一致时续传不会成功，取消该上传，下次运行重新开始
+		if w.Resume && strings.Contains(err.Error(), b2ResumeMismatch) {
+			log.Printf("Unfinished upload of %s does not match the local file, discarding it", remotePath)
+			if cancelErr := b.CancelUnfinishedUpload(remotePath, ""); cancelErr != nil {
+				log.Printf("Warning: Could not cancel unfinished upload of %s: %v", remotePath, cancelErr)
+			}
+			b.resumer.Finish(remotePath)
+			return err
+		}
+		b.recordFailedUpload(remotePath, name)
+		return err
+	}
+	
+	if b.resumer != nil {
+		b.resumer.Finish(remotePath)
+	}
+	return nil
+}
+
+// 上传失败时记录远程未完成上传的ID
+func (b *B2Storage) recordFailedUpload(remotePath, name string) {
+	if b.resumer == nil {
+		return
+	}
+	
+	fileID := ""
+	if obj, err := b.findUnfinishedUpload(name, ""); err == nil && obj != nil {
+		fileID = obj.ID()
+	}
+	
+	b.resumer.Fail(remotePath, fileID)
+	log.Printf("Recorded unfinished upload of %s for resuming on the next run", remotePath)
+}
+
+// 续传前确认使用哪个未完成的上传：blazer按名称续传同名的任意一个，
+// 因此取消记录的上传以外的同名上传；没有记录ID（如进程被终止）时只在恰好有一个时续传
+func (b *B2Storage) selectUnfinishedUpload(name, fileID string) (bool, error) {
+	ctx := context.Background()
+	
+	var selected *b2.Object
+	var others []*b2.Object
+	iterator := b.bucket.List(ctx, b2.ListPrefix(name), b2.ListUnfinished())
+	for iterator.Next() {
+		obj := iterator.Object()
+		if obj.Name() != name {
+			continue
+		}
+		if selected == nil && (fileID == "" || obj.ID() == fileID) {
+			selected = obj
+		} else {
+			others = append(others, obj)
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return false, err
+	}
+	
+	if fileID == "" && selected != nil && len(others) > 0 {
+		log.Printf("Found %d unfinished uploads of %s, starting over", len(others)+1, name)
+		others = append(others, selected)
+		selected = nil
+	}
+	for _, obj := range others {
+		if err := obj.Cancel(ctx); err != nil {
+			log.Printf("Warning: Could not cancel unfinished upload %s of %s: %v", obj.ID(), name, err)
+		}
+	}
+	return selected != nil, nil
+}
+
+// SetUploadResumer 设置续传记录管理器
+func (b *B2Storage) SetUploadResumer(resumer *UploadResumer) {
+	b.resumer = resumer
+}
+
+// CancelUnfinishedUpload 取消B2上未完成的大文件上传
+func (b *B2Storage) CancelUnfinishedUpload(remotePath, fileID string) error {
+	obj, err := b.findUnfinishedUpload(b.objectName(remotePath), fileID)
+	if err != nil || obj == nil {
+		return err
+	}
+	return obj.Cancel(context.Background())
+}
+
+// 查找未完成的大文件上传，fileID为空时返回同名的任意一个
+func (b *B2Storage) findUnfinishedUpload(name, fileID string) (*b2.Object, error) {
+	ctx := context.Background()
+	
+	iterator := b.bucket.List(ctx, b2.ListPrefix(name), b2.ListUnfinished())
+	for iterator.Next() {
+		obj := iterator.Object()
+		if obj.Name() == name && (fileID == "" || obj.ID() == fileID) {
+			return obj, nil
+		}
+	}
+	
+	return nil, iterator.Err()
+}
+
+// 大文件上传进度的日志间隔
+const uploadProgressInterval = 30 * time.Second
+
+// uploadProgress 大文件分片上传进度跟踪
+type uploadProgress struct {
+	storage *B2Storage
+	name    string
+	parts   int
+	done    chan struct{}
+}
+
+// 定期输出大文件的分片上传进度
+func (b *B2Storage) trackUploadProgress(name string, parts int) *uploadProgress {
+	p := &uploadProgress{
+		storage: b,
+		name:    name,
+		parts:   parts,
+		done:    make(chan struct{}),
+	}
+	
+	go func() {
+		ticker := time.NewTicker(uploadProgressInterval)
+		defer ticker.Stop()
+		
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				if percent, completed, ok := p.sample(); ok {
+					log.Printf("Upload progress for %s: %d/%d parts complete (%.1f%%)",
+						name, completed, parts, percent)
+				}
+			}
+		}
+	}()
+	
+	return p
+}
+
+// 从blazer的状态中读取分片进度，返回总体完成百分比和已完成的分片数
+func (p *uploadProgress) sample() (float64, int, bool) {
+	status, ok := p.storage.client.Status().Writers[p.storage.bucket.Name()+"/"+p.name]
+	if !ok {
+		return 0, 0, false
+	}
+	
+	// 已开始的分片中，完成度为1的为已完成分片
+	total, completed := 0.0, 0
+	for _, done := range status.Progress {
+		total += done
+		if done >= 1 {
+			completed++
+		}
+	}
+	return total / float64(p.parts) * 100, completed, true
+}
+
+// 停止进度日志
+func (p *uploadProgress) stop() {
+	close(p.done)
+}
+
 // DeleteFile 删除B2文件
-func (b *B2Storage) DeleteFile(obj *b2.Object) error {
+func (b *B2Storage) DeleteFile(file *RemoteFile) error {
 	ctx := context.Background()
 	
 	// 删除主文件
-	if err := obj.Delete(ctx); err != nil {
+	if err := b.object(file).Delete(ctx); err != nil {
 		return err
 	}
 	
-	// 只有在完整策略下才删除元数据文件
-	if b.config.EnableMetadataCheck && b.config.MetadataStrategy == "full" {
-		fileName := obj.Name()
-		// 从完整路径中提取相对路径
-		relPath := strings.TrimPrefix(fileName, b.config.BackupPrefix)
-		metadataFileName := getMetadataFileName(relPath)
+	// 只有在完整策略下才删除元数据文件，删除历史版本时保留当前版本的元数据
+	if b.config.EnableMetadataCheck && b.config.MetadataStrategy == "full" && file.Latest {
+		metadataFileName := getMetadataFileName(file.Path)
 		
 		// 创建元数据文件对象并删除
-		metadataObj := b.bucket.Object(b.config.BackupPrefix + metadataFileName)
+		metadataObj := b.bucket.Object(b.objectName(metadataFileName))
 		if err := metadataObj.Delete(ctx); err != nil {
 			// 元数据文件可能不存在，忽略错误
-			log.Printf("Note: Could not delete metadata file for %s: %v", fileName, err)
+			log.Printf("Note: Could not delete metadata file for %s: %v", file.Path, err)
 		}
 	}
 	
 	return nil
 }
 
+// HideFile 为B2文件添加隐藏标记，文件不再出现在列表中，但所有版本仍然保留
+func (b *B2Storage) HideFile(file *RemoteFile) error {
+	return b.object(file).Hide(context.Background())
+}
+
 // GetFileList 获取B2文件列表
-func (b *B2Storage) GetFileList() (map[string]*b2.Object, error) {
+func (b *B2Storage) GetFileList() (map[string]*RemoteFile, error) {
+	return b.ListFiles("")
+}
+
+// GetFileAttrs 读取单个B2文件的元数据
+func (b *B2Storage) GetFileAttrs(remotePath string) (*RemoteFile, error) {
+	obj := b.bucket.Object(b.objectName(remotePath))
+	file, err := b.remoteFile(context.Background(), obj)
+	if err != nil {
+		return nil, err
+	}
+	file.Latest = true
+	return file, nil
+}
+
+// ListFiles 列出指定相对路径（文件或目录前缀）下的B2文件
+func (b *B2Storage) ListFiles(remotePath string) (map[string]*RemoteFile, error) {
 	ctx := context.Background()
 	
-	// 列出文件
-	iterator := b.bucket.List(ctx)
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	iterator := b.bucket.List(ctx, b2.ListPrefix(b.config.BackupPrefix+b.encryptor.ListPrefix(remotePath)))
 	
-	fileMap := make(map[string]*b2.Object)
+	fileMap := make(map[string]*RemoteFile)
 	for iterator.Next() {
 		obj := iterator.Object()
-		// 去除前缀
-		relPath := strings.TrimPrefix(obj.Name(), b.config.BackupPrefix)
-		fileMap[relPath] = obj
+		relPath := b.relPath(obj.Name())
+		if !matchesRemotePath(relPath, remotePath) || b.isMetadataFile(relPath) {
+			continue
+		}
+		
+		// 列表返回的属性已缓存，不会产生额外请求
+		file, err := b.remoteFile(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		file.Latest = true
+		addListedFile(fileMap, relPath, file)
 	}
 	
 	if err := iterator.Err(); err != nil {
@@ -183,44 +473,208 @@ func (b *B2Storage) GetFileList() (map[string]*b2.Object, error) {
 	return fileMap, nil
 }
 
-// ManageRetention 管理备份保留策略
-func (b *B2Storage) ManageRetention() error {
-	ctx := context.Background()
-
-	// 列出所有备份文件
-	iterator := b.bucket.List(ctx)
+// ListFilesAsOf 列出指定时间点时每个文件的有效版本（包括之后被删除或覆盖的文件）
+func (b *B2Storage) ListFilesAsOf(remotePath string, asOf time.Time) (map[string]*RemoteFile, error) {
+	versions, err := b.ListFileVersions(remotePath)
+	if err != nil {
+		return nil, err
+	}
 	
-	// 计算保留截止时间
-	retentionCutoff := time.Now().AddDate(0, 0, -b.config.RetentionDays)
+	fileMap := make(map[string]*RemoteFile)
+	for relPath, fileVersions := range versions {
+		if file := versionAsOf(fileVersions, asOf); file != nil {
+			fileMap[relPath] = file
+		}
+	}
+	
+	return fileMap, nil
+}
 
+// ListFileVersions 列出指定相对路径下每个文件的所有版本（包括隐藏标记）
+func (b *B2Storage) ListFileVersions(remotePath string) (map[string][]*RemoteFile, error) {
+	ctx := context.Background()
+	
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	
+	// ListHidden 会列出所有文件版本（包括隐藏标记）
+	iterator := b.bucket.List(ctx, b2.ListPrefix(b.config.BackupPrefix+b.encryptor.ListPrefix(remotePath)), b2.ListHidden())
+	
+	versions := make(map[string][]*RemoteFile)
 	for iterator.Next() {
 		obj := iterator.Object()
-		
-		// 只处理指定前缀的文件
-		if !strings.HasPrefix(obj.Name(), b.config.BackupPrefix) {
+		relPath := b.relPath(obj.Name())
+		if !matchesRemotePath(relPath, remotePath) || b.isMetadataFile(relPath) {
 			continue
 		}
 		
-		// 获取文件属性
 		attrs, err := obj.Attrs(ctx)
 		if err != nil {
-			log.Printf("Error getting attrs for %s: %v", obj.Name(), err)
+			return nil, err
+		}
+		
+		// 跳过未完成的大文件上传
+		if attrs.Status != b2.Uploaded && attrs.Status != b2.Hider {
 			continue
 		}
 		
-		// 检查文件时间
-		if attrs.UploadTimestamp.Before(retentionCutoff) {
-			log.Printf("Deleting old backup: %s (uploaded: %s)", 
-				obj.Name(), attrs.UploadTimestamp)
-			
-			// 删除文件
-			if err := obj.Delete(ctx); err != nil {
-				log.Printf("Error deleting file %s: %v", obj.Name(), err)
-			}
+		// 列表结果中的属性已缓存，不会产生额外请求
+		file, err := b.remoteFile(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		file.Hidden = attrs.Status == b2.Hider
+		versions[relPath] = append(versions[relPath], file)
+	}
+	
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	
+	// 最新的版本如果不是隐藏标记，就是当前可见的版本
+	sortVersions(versions)
+	for _, fileVersions := range versions {
+		if !fileVersions[0].Hidden {
+			fileVersions[0].Latest = true
 		}
 	}
 	
-	return iterator.Err()
+	return versions, nil
+}
+
+// DownloadFile 下载B2文件到本地路径，返回解密后内容的SHA1校验和
+func (b *B2Storage) DownloadFile(file *RemoteFile, localPath string) (string, error) {
+	// 历史版本只能按文件ID下载
+	if !file.Latest {
+		return b.downloadFileVersion(file, localPath)
+	}
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	reader := b.object(file).NewReader(ctx)
+	defer reader.Close()
+	
+	checksum, encrypted, err := writeDownload(b.encryptor, reader, localPath, fileFormat(file.Info, file.UploadTimestamp))
+	file.Encrypted = file.Encrypted || encrypted
+	return checksum, err
+}
+
+// 将B2对象转换为通用的远程文件信息
+func (b *B2Storage) remoteFile(ctx context.Context, obj *b2.Object) (*RemoteFile, error) {
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	
+	// 大文件可能没有记录SHA1（值为 "none"）；加密和压缩文件的SHA1不是原始内容的，不能用于校验
+	sha := attrs.SHA1
+	encrypted := attrs.Info[encryptionInfoKey] != ""
+	if len(sha) != 40 || encrypted || attrs.Info[compressionInfoKey] != "" {
+		sha = ""
+	}
+	
+	return &RemoteFile{
+		Path:            b.relPath(obj.Name()),
+		ID:              obj.ID(),
+		Size:            attrs.Size,
+		SHA1:            sha,
+		UploadTimestamp: attrs.UploadTimestamp,
+		LastModified:    attrs.LastModified,
+		Info:            attrs.Info,
+		Encrypted:       encrypted,
+		handle:          obj,
+	}, nil
+}
+
+// 获取远程文件对应的B2对象
+func (b *B2Storage) object(file *RemoteFile) *b2.Object {
+	if obj, ok := file.handle.(*b2.Object); ok {
+		return obj
+	}
+	return b.bucket.Object(b.objectName(file.Path))
+}
+
+// 获取相对路径对应的B2对象名，启用文件名加密时使用加密后的名称
+func (b *B2Storage) objectName(relPath string) string {
+	return b.config.BackupPrefix + b.encryptor.EncryptName(relPath)
+}
+
+// 获取B2对象名对应的相对路径
+func (b *B2Storage) relPath(name string) string {
+	return b.encryptor.DecryptName(strings.TrimPrefix(name, b.config.BackupPrefix))
+}
+
+// 检查是否为元数据文件（仅完整策略下存在）
+func (b *B2Storage) isMetadataFile(relPath string) bool {
+	return b.config.EnableMetadataCheck && b.config.MetadataStrategy == "full" && strings.HasSuffix(relPath, ".meta")
+}
+
+// 按文件ID下载指定版本到本地路径，返回解密后内容的SHA1校验和
+// blazer 只支持按文件名下载最新版本，因此这里直接调用 b2_download_file_by_id
+func (b *B2Storage) downloadFileVersion(file *RemoteFile, localPath string) (string, error) {
+	auth, err := b.authorizeAccount()
+	if err != nil {
+		return "", err
+	}
+	
+	downloadURL := fmt.Sprintf("%s/b2api/v2/b2_download_file_by_id?fileId=%s", auth.DownloadURL, url.QueryEscape(file.ID))
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("download of file %s failed: %s: %s", file.ID, resp.Status, strings.TrimSpace(string(body)))
+	}
+	
+	checksum, encrypted, err := writeDownload(b.encryptor, resp.Body, localPath, fileFormat(file.Info, file.UploadTimestamp))
+	file.Encrypted = file.Encrypted || encrypted
+	return checksum, err
+}
+
+// b2_authorize_account 的响应中用到的字段
+type b2Authorization struct {
+	AuthorizationToken string `json:"authorizationToken"`
+	DownloadURL        string `json:"downloadUrl"`
+}
+
+// 获取账户授权（用于blazer未提供的原生API调用），结果会被缓存
+func (b *B2Storage) authorizeAccount() (*b2Authorization, error) {
+	if b.auth != nil {
+		return b.auth, nil
+	}
+	
+	req, err := http.NewRequest(http.MethodGet, "https://api.backblazeb2.com/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(b.config.AccountID, b.config.ApplicationKey)
+	
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("b2_authorize_account failed: %s", resp.Status)
+	}
+	
+	auth := &b2Authorization{}
+	if err := json.NewDecoder(resp.Body).Decode(auth); err != nil {
+		return nil, err
+	}
+	
+	b.auth = auth
+	return auth, nil
 }
 
 // 存储文件元数据到B2
@@ -239,7 +693,7 @@ func (b *B2Storage) storeFileMetadata(remotePath, checksum string, size int64, m
 		return err
 	}
 	
-	metadataObj := b.bucket.Object(b.config.BackupPrefix + getMetadataFileName(remotePath))
+	metadataObj := b.bucket.Object(b.objectName(getMetadataFileName(remotePath)))
 	w := metadataObj.NewWriter(ctx)
 	
 	if _, err := w.Write(metadataJSON); err != nil {
@@ -254,7 +708,7 @@ func (b *B2Storage) storeFileMetadata(remotePath, checksum string, size int64, m
 func (b *B2Storage) getFileMetadata(remotePath string) (map[string]interface{}, error) {
 	ctx := context.Background()
 	
-	metadataObj := b.bucket.Object(b.config.BackupPrefix + getMetadataFileName(remotePath))
+	metadataObj := b.bucket.Object(b.objectName(getMetadataFileName(remotePath)))
 	
 	// 尝试获取元数据文件
 	reader := metadataObj.NewReader(ctx)
@@ -268,6 +722,65 @@ func (b *B2Storage) getFileMetadata(remotePath string) (map[string]interface{},
 	return metadata, nil
 }
 
+// PutBlob 上传对象到指定的完整对象名
+func (b *B2Storage) PutBlob(name string, r io.Reader, size int64) error {
+	w := b.bucket.Object(name).NewWriter(context.Background())
+	w.ChunkSize, w.ConcurrentUploads = uploadPartSettings(b.config, size)
+	
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// GetBlob 读取指定完整对象名的内容
+func (b *B2Storage) GetBlob(name string) (io.ReadCloser, error) {
+	return b.bucket.Object(name).NewReader(context.Background()), nil
+}
+
+// GetBlobRange 读取指定完整对象名中的一段内容
+func (b *B2Storage) GetBlobRange(name string, offset, length int64) (io.ReadCloser, error) {
+	return b.bucket.Object(name).NewRangeReader(context.Background(), offset, length), nil
+}
+
+// ListBlobs 列出指定前缀下的对象
+func (b *B2Storage) ListBlobs(prefix string) (map[string]*RemoteFile, error) {
+	ctx := context.Background()
+	
+	iterator := b.bucket.List(ctx, b2.ListPrefix(prefix))
+	blobs := make(map[string]*RemoteFile)
+	for iterator.Next() {
+		obj := iterator.Object()
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		blobs[obj.Name()] = &RemoteFile{
+			Path:            obj.Name(),
+			ID:              obj.ID(),
+			Size:            attrs.Size,
+			UploadTimestamp: attrs.UploadTimestamp,
+			Latest:          true,
+			handle:          obj,
+		}
+	}
+	
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// DeleteBlob 删除对象
+func (b *B2Storage) DeleteBlob(file *RemoteFile) error {
+	obj, ok := file.handle.(*b2.Object)
+	if !ok {
+		obj = b.bucket.Object(file.Path)
+	}
+	return obj.Delete(context.Background())
+}
+
 // Close 关闭B2连接
 func (b *B2Storage) Close() error {
 	// B2客户端通常不需要显式关闭，但这里可以添加清理逻辑
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 仓库模式
+const (
+	RepositoryModeFiles   = "files"   // 每个文件上传为一个对象（默认）
+	RepositoryModeChunked = "chunked" // 文件按内容切分为分块，分块按哈希去重存储
+	RepositoryModePacked  = "packed"  // 小文件打包为较大的包对象上传
+)
+
+// 内容定义分块参数：分块边界由内容决定，文件中间插入或删除数据只影响附近的分块
+const (
+	cdcMinSize = 256 * 1024
+	cdcMaxSize = 4 * 1024 * 1024
+	cdcMask    = uint64(1<<20-1) << 44 // 超过最小长度后平均每1MB出现一次边界
+)
+
+// 分块清单格式：头部之后是JSON，作为文件的内容上传到文件原来的路径
+// 分块清单在对象元数据中标记，下载时按标记区分分块清单和普通文件，不按内容开头判断
+const (
+	chunkRecipeMagic   = "B2GOCHUNKS\n"
+	chunkRecipeVersion = 1
+
+	chunkRecipeInfoKey   = "chunks"
+	chunkRecipeInfoValue = "recipe"
+)
+
+// 上传后还没有被分块清单引用的分块在该时间内不会被清理（可能属于正在进行的备份）
+const chunkGCGracePeriod = 24 * time.Hour
+
+// Gear 哈希表，由固定种子生成，保证同样的内容总是切分出同样的分块
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// BlobStorage 按完整对象名（相对于bucket根目录，不受 BACKUP_PREFIX 影响）存取对象的存储后端
+type BlobStorage interface {
+	// PutBlob 上传对象
+	PutBlob(name string, r io.Reader, size int64) error
+	// GetBlob 读取对象内容
+	GetBlob(name string) (io.ReadCloser, error)
+	// GetBlobRange 读取对象中从 offset 开始的 length 字节
+	GetBlobRange(name string, offset, length int64) (io.ReadCloser, error)
+	// ListBlobs 列出指定前缀下的对象，键为完整对象名
+	ListBlobs(prefix string) (map[string]*RemoteFile, error)
+	// DeleteBlob 删除对象
+	DeleteBlob(file *RemoteFile) error
+}
+
+// chunkRecipe 分块清单，记录文件由哪些分块按顺序组成
+type chunkRecipe struct {
+	Version int        `json:"version"`
+	Size    int64      `json:"size"`
+	SHA1    string     `json:"sha1"`
+	Chunks  []chunkRef `json:"chunks"`
+}
+
+// chunkRef 分块引用
+type chunkRef struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+// pendingChunk 正在上传的分块，其他协程遇到同一分块时等待上传结果
+type pendingChunk struct {
+	done chan struct{}
+	err  error
+}
+
+// ChunkedStorage 分块去重存储，包装普通的存储后端
+// 文件被切分为内容定义的分块，分块以内容哈希命名存储在 CHUNK_PREFIX 下，相同的分块只存储一次；
+// 文件原来的路径上存储分块清单，因此列表、版本、隐藏、保留策略和时间点恢复都照常工作
+type ChunkedStorage struct {
+	Storage
+	blobs      BlobStorage
+	uploader   OptionUploader
+	config     Config
+	encryptor  *Encryptor
+	compressor *Compressor
+
+	loadOnce sync.Once
+	loadErr  error
+	mu       sync.Mutex
+	stored   map[string]bool          // 已存储的分块ID
+	pending  map[string]*pendingChunk // 正在上传的分块
+
+	newChunks    int64
+	newBytes     int64
+	reusedChunks int64
+}
+
+// NewChunkedStorage 创建新的分块去重存储实例，storage 必须支持 BlobStorage 和 OptionUploader
+func NewChunkedStorage(config Config, storage Storage, encryptor *Encryptor, compressor *Compressor) (*ChunkedStorage, error) {
+	blobs, ok := storage.(BlobStorage)
+	uploader, canUpload := storage.(OptionUploader)
+	if !ok || !canUpload {
+		return nil, fmt.Errorf("storage backend %s does not support the chunked repository mode", config.StorageBackend)
+	}
+
+	return &ChunkedStorage{
+		Storage:    storage,
+		blobs:      blobs,
+		uploader:   uploader,
+		config:     config,
+		encryptor:  encryptor,
+		compressor: compressor,
+		pending:    make(map[string]*pendingChunk),
+	}, nil
+}
+
+// UploadFile 切分文件并上传尚未存储的分块，然后将分块清单上传到文件的路径
+func (c *ChunkedStorage) UploadFile(localPath, remotePath, checksum string) error {
+	if err := c.loadStoredChunks(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	recipe := chunkRecipe{Version: chunkRecipeVersion, SHA1: checksum, Chunks: []chunkRef{}}
+	chunker := newChunker(file)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		id := c.encryptor.ChecksumTag(hex.EncodeToString(sum[:]))
+		if err := c.storeChunk(id, data); err != nil {
+			return fmt.Errorf("failed to upload chunk %s: %v", id, err)
+		}
+		recipe.Chunks = append(recipe.Chunks, chunkRef{ID: id, Size: len(data)})
+		recipe.Size += int64(len(data))
+	}
+
+	// 分块清单通过原存储后端上传，沿用其压缩和加密；修改后大小不变的文件的分块清单长度也不变，
+	// 按大小的重复检测会跳过新的清单，因此总是上传（只有内容变化的文件才会调用 UploadFile）
+	tmp, err := os.CreateTemp("", "b2-go-recipe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(chunkRecipeMagic)
+	if err == nil {
+		err = json.NewEncoder(tmp).Encode(recipe)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.uploader.UploadFileWithOptions(tmp.Name(), remotePath, checksum, UploadOptions{
+		Force: true,
+		Info:  map[string]string{chunkRecipeInfoKey: chunkRecipeInfoValue},
+	})
+}
+
+// DownloadFile 下载分块清单并按顺序拼接分块，返回文件内容的SHA1校验和
+// 启用分块模式之前上传的普通文件原样下载
+func (c *ChunkedStorage) DownloadFile(file *RemoteFile, localPath string) (string, error) {
+	tmpPath := localPath + ".recipe"
+	checksum, err := c.Storage.DownloadFile(file, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if !isChunkRecipe(file) {
+		if err := os.Rename(tmpPath, localPath); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+		return checksum, nil
+	}
+	recipe, err := readChunkRecipe(tmpPath)
+	os.Remove(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read chunk recipe: %v", err)
+	}
+
+	// 存储后端记录的是分块清单的SHA1，校验时应使用文件内容的SHA1
+	file.SHA1 = recipe.SHA1
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.New()
+	w := io.MultiWriter(out, hash)
+	for _, ref := range recipe.Chunks {
+		data, err := c.readChunk(ref.ID, file.UploadTimestamp)
+		if err == nil && len(data) != ref.Size {
+			err = fmt.Errorf("size mismatch: got %d bytes, want %d", len(data), ref.Size)
+		}
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			out.Close()
+			return "", fmt.Errorf("chunk %s: %v", ref.ID, err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Close 输出分块上传统计并关闭存储后端
+func (c *ChunkedStorage) Close() error {
+	if newChunks, reused := atomic.LoadInt64(&c.newChunks), atomic.LoadInt64(&c.reusedChunks); newChunks+reused > 0 {
+		log.Printf("Chunk store: uploaded %d new chunks (%d bytes), reused %d existing chunks",
+			newChunks, atomic.LoadInt64(&c.newBytes), reused)
+	}
+	return c.Storage.Close()
+}
+
+// CollectGarbage 删除不再被任何文件版本的分块清单引用的分块，dryRun 时只列出
+// 需要下载所有版本的分块清单；任何清单无法读取时不删除任何分块
+func (c *ChunkedStorage) CollectGarbage(dryRun bool) (int, error) {
+	versions, err := c.Storage.ListFileVersions("")
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp("", "b2-go-recipe-*")
+	if err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	referenced := make(map[string]bool)
+	for relPath, fileVersions := range versions {
+		for _, file := range fileVersions {
+			if file.Hidden {
+				continue
+			}
+			if _, err := c.Storage.DownloadFile(file, tmp.Name()); err != nil {
+				return 0, fmt.Errorf("failed to read chunk recipe of %s (uploaded %s): %v", relPath, file.UploadTimestamp.Format(time.RFC3339), err)
+			}
+			if !isChunkRecipe(file) {
+				continue
+			}
+			recipe, err := readChunkRecipe(tmp.Name())
+			if err != nil {
+				return 0, fmt.Errorf("failed to read chunk recipe of %s: %v", relPath, err)
+			}
+			for _, ref := range recipe.Chunks {
+				referenced[ref.ID] = true
+			}
+		}
+	}
+
+	chunks, err := c.blobs.ListBlobs(c.config.ChunkPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-chunkGCGracePeriod)
+	deleted := 0
+	for name, chunk := range chunks {
+		if referenced[path.Base(name)] || chunk.UploadTimestamp.After(cutoff) {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would delete unreferenced chunk %s (%d bytes)\n", name, chunk.Size)
+		} else {
+			log.Printf("Deleting unreferenced chunk: %s", name)
+			if err := c.blobs.DeleteBlob(chunk); err != nil {
+				log.Printf("Error deleting chunk %s: %v", name, err)
+				continue
+			}
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// 列出已存储的分块，每次运行只列出一次
+func (c *ChunkedStorage) loadStoredChunks() error {
+	c.loadOnce.Do(func() {
+		chunks, err := c.blobs.ListBlobs(c.config.ChunkPrefix)
+		if err != nil {
+			c.loadErr = fmt.Errorf("failed to list stored chunks: %v", err)
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.stored = make(map[string]bool, len(chunks))
+		for name := range chunks {
+			c.stored[path.Base(name)] = true
+		}
+		log.Printf("Chunk store: %d chunks already stored under %s", len(c.stored), c.config.ChunkPrefix)
+	})
+	return c.loadErr
+}
+
+// 上传尚未存储的分块，多个协程同时遇到同一分块时只上传一次
+func (c *ChunkedStorage) storeChunk(id string, data []byte) error {
+	c.mu.Lock()
+	if c.stored[id] {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.reusedChunks, 1)
+		return nil
+	}
+	if pending, ok := c.pending[id]; ok {
+		c.mu.Unlock()
+		<-pending.done
+		if pending.err == nil {
+			atomic.AddInt64(&c.reusedChunks, 1)
+		}
+		return pending.err
+	}
+	pending := &pendingChunk{done: make(chan struct{})}
+	c.pending[id] = pending
+	c.mu.Unlock()
+
+	// 先压缩再加密，分块内容带有格式头部，读取时不需要元数据
+	payload := c.compressor.EncodeBytes(data)
+	name := c.chunkName(id)
+	content, size := c.encryptor.UploadReader(bytes.NewReader(payload), int64(len(payload)))
+	pending.err = c.blobs.PutBlob(name, content, size)
+
+	c.mu.Lock()
+	delete(c.pending, id)
+	if pending.err == nil {
+		c.stored[id] = true
+	}
+	c.mu.Unlock()
+	close(pending.done)
+
+	if pending.err == nil {
+		atomic.AddInt64(&c.newChunks, 1)
+		atomic.AddInt64(&c.newBytes, size)
+	}
+	return pending.err
+}
+
+// 下载分块并验证内容与分块ID一致，分块不晚于引用它的分块清单上传（uploaded 为清单的上传时间）
+func (c *ChunkedStorage) readChunk(id string, uploaded time.Time) ([]byte, error) {
+	reader, err := c.blobs.GetBlob(c.chunkName(id))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, _, err := openDownload(c.encryptor, reader, blobFormat(uploaded))
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if c.encryptor.ChecksumTag(hex.EncodeToString(sum[:])) != id {
+		return nil, fmt.Errorf("content does not match chunk ID")
+	}
+	return data, nil
+}
+
+// 分块的对象名，按ID前两位分目录，避免本地存储后端单个目录中文件过多
+func (c *ChunkedStorage) chunkName(id string) string {
+	return c.config.ChunkPrefix + id[:2] + "/" + id
+}
+
+// 文件对象是否为分块清单，启用分块模式之前上传的普通文件没有标记
+// S3和本地存储后端的列表结果可能不包含元数据，需要在 DownloadFile 之后判断
+func isChunkRecipe(file *RemoteFile) bool {
+	return file.Info[chunkRecipeInfoKey] == chunkRecipeInfoValue
+}
+
+// 读取下载的分块清单
+func readChunkRecipe(filePath string) (*chunkRecipe, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(chunkRecipeMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != chunkRecipeMagic {
+		return nil, fmt.Errorf("missing chunk recipe header")
+	}
+
+	recipe := &chunkRecipe{}
+	if err := json.NewDecoder(reader).Decode(recipe); err != nil {
+		return nil, err
+	}
+	if recipe.Version != chunkRecipeVersion {
+		return nil, fmt.Errorf("unsupported chunk recipe version %d", recipe.Version)
+	}
+	return recipe, nil
+}
+
+// chunker 内容定义分块器（Gear 滚动哈希）
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int // 缓冲区中的有效数据量
+	eof bool
+}
+
+// newChunker 创建新的分块器实例
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, cdcMaxSize),
+	}
+}
+
+// Next 返回下一个分块，没有更多数据时返回 io.EOF
+func (c *chunker) Next() ([]byte, error) {
+	// 将缓冲区填满到最大分块大小
+	for c.n < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.n:])
+		c.n += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := cutPoint(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+
+	// 剩余的数据移到缓冲区开头
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// 在数据中查找分块边界，数据不超过最大分块大小
+func cutPoint(data []byte) int {
+	if len(data) <= cdcMinSize {
+		return len(data)
+	}
+
+	var hash uint64
+	for i := cdcMinSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&cdcMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
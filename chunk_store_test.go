@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 原地修改后大小不变的文件，分块清单长度也不变，仍然要上传新的清单
+func TestChunkedStorageRewriteSameSize(t *testing.T) {
+	config := newTestConfig(t)
+	config.RepositoryMode = RepositoryModeChunked
+	config.MetadataStrategy = "basic"
+	writeTestFile(t, config.SourceDir, "a.txt", "original content")
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	state := &LocalState{Files: make(map[string]*FileState)}
+	runTestBackup(t, config, storage, state)
+
+	writeTestFile(t, config.SourceDir, "a.txt", "modified content")
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(config.SourceDir, "a.txt"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if stats := runTestBackup(t, config, storage, state); stats["uploaded"] != 1 {
+		t.Fatalf("backup after rewrite uploaded %d files, want 1", stats["uploaded"])
+	}
+
+	target := filepath.Join(t.TempDir(), "restore")
+	stats, err := NewRestorer(config, storage, state).Restore(RestoreOptions{TargetDir: target, Overwrite: OverwriteSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["restored"] != 1 || stats["failed"] != 0 {
+		t.Fatalf("restore stats %v", stats)
+	}
+	checkRestoredFiles(t, target, map[string]string{"a.txt": "modified content"})
+}
+
+// 启用分块模式之前上传的普通文件即使以分块清单的头部开始，也按普通文件恢复
+func TestChunkedStoragePlainFileWithRecipeHeader(t *testing.T) {
+	config := newTestConfig(t)
+	content := chunkRecipeMagic + `{"version":1,"size":0,"sha1":"","chunks":[]}` + "\n"
+	writeTestFile(t, config.SourceDir, "recipe.txt", content)
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &LocalState{Files: make(map[string]*FileState)}
+	runTestBackup(t, config, storage, state)
+	storage.Close()
+
+	config.RepositoryMode = RepositoryModeChunked
+	chunked, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunked.Close()
+
+	target := filepath.Join(t.TempDir(), "restore")
+	stats, err := NewRestorer(config, chunked, state).Restore(RestoreOptions{TargetDir: target, Overwrite: OverwriteSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["restored"] != 1 || stats["failed"] != 0 {
+		t.Fatalf("restore stats %v", stats)
+	}
+	checkRestoredFiles(t, target, map[string]string{"recipe.txt": content})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩文件格式：头部 "B2GOZ" | 版本(1) | 算法(1)，之后是对应算法的压缩流
+// 文件对象是否压缩由对象元数据中的压缩算法决定，不按内容开头判断，
+// 未压缩上传的文件即使恰好以同样的字节开始也原样恢复；
+// 内部对象（分块、包、索引、快照、锁）总是带有头部，不值得压缩时算法为原样存储
+const (
+	compressionMagic   = "B2GOZ"
+	compressionVersion = 1
+
+	compressionStored = 0 // 未压缩，头部之后是原始内容
+	compressionGzip   = 1
+	compressionZstd   = 2
+
+	// 对象元数据中记录压缩算法的键
+	compressionInfoKey = "compression"
+)
+
+// 压缩算法配置值
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+const (
+	compressionSampleSize = 128 * 1024 // 判断是否值得压缩时试压缩的数据量
+	compressionMinRatio   = 0.9        // 样本压缩后不小于原大小的该比例时不压缩
+)
+
+// 已经压缩过的文件格式，再次压缩几乎没有效果
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".bz2": true, ".lz4": true, ".br": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".flac": true, ".opus": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true,
+}
+
+// Compressor 上传前压缩文件内容
+// 方法都可以在 nil 上调用，此时不压缩
+type Compressor struct {
+	algorithm byte
+	level     int
+}
+
+// NewCompressor 根据配置创建压缩器，未启用压缩时返回 nil
+func NewCompressor(config Config) (*Compressor, error) {
+	switch config.Compression {
+	case "", CompressionNone:
+		return nil, nil
+	case CompressionGzip:
+		level := config.CompressionLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid COMPRESSION_LEVEL %d for gzip (-2 to 9: -2 Huffman only, -1 or 0 default, 1-9 fastest to smallest)", config.CompressionLevel)
+		}
+		return &Compressor{algorithm: compressionGzip, level: level}, nil
+	case CompressionZstd:
+		level := config.CompressionLevel
+		if level == 0 {
+			level = 3
+		}
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("invalid COMPRESSION_LEVEL %d for zstd (1 to 22: 1-2 fastest, 3-5 default, 6-9 better, 10-22 best; 0 default)", config.CompressionLevel)
+		}
+		return &Compressor{algorithm: compressionZstd, level: level}, nil
+	default:
+		return nil, fmt.Errorf("unknown COMPRESSION %q (none, gzip or zstd)", config.Compression)
+	}
+}
+
+// compressedUpload 待上传的（可能已压缩的）文件内容
+type compressedUpload struct {
+	io.Reader
+	Size      int64  // 上传内容的大小
+	Algorithm string // 压缩算法，未压缩时为空
+	tmp       *os.File
+}
+
+// Close 删除压缩时使用的临时文件
+func (u *compressedUpload) Close() error {
+	if u.tmp == nil {
+		return nil
+	}
+	u.tmp.Close()
+	return os.Remove(u.tmp.Name())
+}
+
+// Compress 返回上传使用的内容，file 的读取位置必须在开头
+// 已压缩格式的文件和试压缩样本没有明显变小的文件原样返回；
+// 需要压缩时先写入临时文件，上传前就能确定大小（分片上传和续传都依赖这一点）
+func (c *Compressor) Compress(file *os.File, remotePath string, size int64) (*compressedUpload, error) {
+	raw := &compressedUpload{Reader: file, Size: size}
+	if c == nil || compressedExtensions[strings.ToLower(filepath.Ext(remotePath))] {
+		return raw, nil
+	}
+
+	worth, err := c.worthCompressing(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if !worth {
+		return raw, nil
+	}
+
+	tmp, err := os.CreateTemp("", "b2-go-compress-*")
+	if err != nil {
+		return nil, err
+	}
+	upload := &compressedUpload{Reader: tmp, Algorithm: c.Name(), tmp: tmp}
+
+	if err := c.compressTo(tmp, file); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	if upload.Size, err = tmp.Seek(0, io.SeekCurrent); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		upload.Close()
+		return nil, err
+	}
+
+	log.Printf("Compressed %s with %s: %d -> %d bytes", remotePath, upload.Algorithm, size, upload.Size)
+	return upload, nil
+}
+
+// EncodeBytes 压缩内存中的数据（如分块）并加上压缩头部，未启用压缩或压缩后没有明显变小时原样存储
+func (c *Compressor) EncodeBytes(data []byte) []byte {
+	if c == nil || len(data) == 0 {
+		return storedBytes(data)
+	}
+
+	var buf bytes.Buffer
+	if err := c.compressTo(&buf, bytes.NewReader(data)); err != nil {
+		return storedBytes(data)
+	}
+	if float64(buf.Len()) >= float64(len(data))*compressionMinRatio {
+		return storedBytes(data)
+	}
+	return buf.Bytes()
+}
+
+// 加上原样存储的压缩头部
+func storedBytes(data []byte) []byte {
+	framed := make([]byte, 0, len(compressionMagic)+2+len(data))
+	framed = append(framed, compressionMagic...)
+	framed = append(framed, compressionVersion, compressionStored)
+	return append(framed, data...)
+}
+
+// Name 返回压缩算法名称
+func (c *Compressor) Name() string {
+	if c == nil {
+		return ""
+	}
+	if c.algorithm == compressionGzip {
+		return CompressionGzip
+	}
+	return CompressionZstd
+}
+
+// 试压缩文件开头的样本，判断压缩是否有效
+func (c *Compressor) worthCompressing(file *os.File) (bool, error) {
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := c.compressTo(&buf, bytes.NewReader(sample[:n])); err != nil {
+		return false, err
+	}
+	return float64(buf.Len()) < float64(n)*compressionMinRatio, nil
+}
+
+// 写入压缩头部和压缩流
+func (c *Compressor) compressTo(w io.Writer, r io.Reader) error {
+	if _, err := w.Write(append([]byte(compressionMagic), compressionVersion, c.algorithm)); err != nil {
+		return err
+	}
+
+	var zw io.WriteCloser
+	switch c.algorithm {
+	case compressionGzip:
+		gw, err := gzip.NewWriterLevel(w, c.level)
+		if err != nil {
+			return err
+		}
+		zw = gw
+	default:
+		// 单线程压缩保证相同内容的输出一致，大文件续传时已上传的分片才能匹配
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		zw = enc
+	}
+
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// 读取压缩头部并返回解压后的内容，内容必须以压缩头部开始
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(compressionMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(compressionMagic)]) != compressionMagic {
+		return nil, fmt.Errorf("missing compression header")
+	}
+
+	version, algorithm := header[len(compressionMagic)], header[len(compressionMagic)+1]
+	if version != compressionVersion {
+		return nil, fmt.Errorf("unsupported compression format version %d", version)
+	}
+
+	switch algorithm {
+	case compressionStored:
+		return io.NopCloser(br), nil
+	case compressionGzip:
+		return gzip.NewReader(br)
+	case compressionZstd:
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %d", algorithm)
+	}
+}
@@ -29,8 +29,24 @@ func NewEmailNotification(config EmailConfig) *EmailNotification {
 	}
 }
 
-// SendNotification 发送邮件通知
-func (e *EmailNotification) SendNotification(success bool, stats map[string]int) error {
+// 邮件中最多列出的无法读取路径数
+const maxEmailScanErrors = 50
+
+// 列出无法读取的路径，最多 maxEmailScanErrors 个
+func formatScanErrors(scanErrors []ScanError) string {
+	msg := fmt.Sprintf("Unreadable paths: %d\n", len(scanErrors))
+	for i, scanErr := range scanErrors {
+		if i == maxEmailScanErrors {
+			msg += fmt.Sprintf("... and %d more\n", len(scanErrors)-maxEmailScanErrors)
+			break
+		}
+		msg += fmt.Sprintf("  %s: %v\n", scanErr.Path, scanErr.Err)
+	}
+	return msg
+}
+
+// SendNotification 发送邮件通知，scanErrors 为扫描时无法读取的路径
+func (e *EmailNotification) SendNotification(success bool, stats map[string]int, scanErrors []ScanError) error {
 	// 检查是否启用邮件通知
 	if !e.config.Enabled {
 		log.Println("Email notification disabled")
@@ -44,13 +60,20 @@ func (e *EmailNotification) SendNotification(success bool, stats map[string]int)
 	}
 
 	subject := "Backup Failed"
-	if success {
+	if success && len(scanErrors) > 0 {
+		subject = "Backup Succeeded With Unreadable Paths"
+	} else if success {
 		subject = "Backup Succeeded"
 	}
 
 	// 构建统计信息
 	statsMsg := fmt.Sprintf("Files uploaded: %d\nFiles deleted: %d\nFiles skipped: %d",
 		stats["uploaded"], stats["deleted"], stats["skipped"])
+	
+	// 列出无法读取的路径
+	if len(scanErrors) > 0 {
+		statsMsg += "\n" + formatScanErrors(scanErrors)
+	}
 
 	body := fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\n\nBackup Summary:\n%s",
 		e.config.From, e.config.To, subject, statsMsg)
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// 加密文件格式（整数均为大端序）：
+//
+//	头部：魔数 "B2GOENC" | 版本(1) | 算法(1) | 密钥派生方式(1) | 分块大小(4) | 派生盐(16) | 文件随机数(24)
+//	数据：按分块大小切分的明文，每块单独使用 AES-256-GCM 加密并附带16字节认证标签
+//
+// 文件随机数每次上传随机生成，文件密钥由主密钥和文件随机数派生；
+// 每块的nonce由块序号和最后一块标记组成，整个头部作为附加认证数据，
+// 因此块被截断、重排、替换或头部被篡改都会导致解密失败。
+// 口令派生主密钥使用的盐在仓库创建时随机生成，保存在 keys/ 加上 BACKUP_PREFIX 下的盐对象中；
+// 盐对象同时记录启用加密的时间并由主密钥认证，配置了密钥时只接受在此之前上传的未加密对象，
+// 能写入bucket的人无法用未加密的内容替换加密的对象
+const (
+	encryptionMagic      = "B2GOENC"
+	encryptionVersion    = 1
+	encryptionChunkSize  = 64 * 1024
+	encryptionSaltSize   = 16
+	encryptionNonceSize  = 24
+	encryptionHeaderSize = len(encryptionMagic) + 3 + 4 + encryptionSaltSize + encryptionNonceSize
+	encryptionTagSize    = 16
+
+	cipherAES256GCM = 1
+
+	kdfKeyFile = 0 // 密钥文件内容的SHA256
+	kdfScrypt  = 1 // 口令经 scrypt 派生
+
+	// 对象元数据中记录加密参数的键
+	encryptionInfoKey = "encryption"
+
+	// 仓库盐对象的名称后缀
+	repositorySaltSuffix = "salt"
+)
+
+// scrypt 参数（N=2^15, r=8, p=1）
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Encryptor 客户端加密器，上传前加密文件内容，下载时解密
+// 方法都可以在 nil 上调用，此时不加密，下载时遇到加密内容会返回错误
+type Encryptor struct {
+	kdf        byte
+	salt       []byte
+	masterKey  []byte
+	passphrase []byte    // 用于派生其他盐值加密的对象的密钥
+	since      time.Time // 仓库启用加密的时间，由 LoadRepositorySalt 读取
+
+	encryptNames bool
+	nameKey      []byte // 文件名加密密钥，为空表示不加密文件名
+	nameMACKey   []byte // 文件名合成IV的密钥
+
+	mu   sync.Mutex
+	keys map[string][]byte // 按派生盐缓存的主密钥
+}
+
+// NewEncryptor 根据配置创建加密器，未配置口令或密钥文件时返回 nil
+// 使用口令时主密钥在 LoadRepositorySalt 读取仓库的盐之后派生，NewStorage 会完成这一步
+func NewEncryptor(config Config) (*Encryptor, error) {
+	if config.EncryptionPassphrase != "" && config.EncryptionKeyFile != "" {
+		return nil, fmt.Errorf("ENCRYPTION_PASSPHRASE and ENCRYPTION_KEY_FILE are mutually exclusive")
+	}
+
+	var e *Encryptor
+	switch {
+	case config.EncryptionKeyFile != "":
+		data, err := os.ReadFile(config.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %v", err)
+		}
+		if len(data) < 32 {
+			return nil, fmt.Errorf("encryption key file must contain at least 32 bytes")
+		}
+		key := sha256.Sum256(data)
+		e = &Encryptor{
+			kdf:          kdfKeyFile,
+			encryptNames: config.EncryptFileNames,
+			keys:         make(map[string][]byte),
+		}
+		e.setMasterKey(make([]byte, encryptionSaltSize), key[:])
+	case config.EncryptionPassphrase != "":
+		e = &Encryptor{
+			kdf:          kdfScrypt,
+			passphrase:   []byte(config.EncryptionPassphrase),
+			encryptNames: config.EncryptFileNames,
+			keys:         make(map[string][]byte),
+		}
+	case config.EncryptFileNames:
+		return nil, fmt.Errorf("ENCRYPT_FILE_NAMES requires ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE")
+	default:
+		return nil, nil
+	}
+
+	return e, nil
+}
+
+// repositorySalt 仓库盐对象的内容
+type repositorySalt struct {
+	KDF     string    `json:"kdf"`
+	Salt    string    `json:"salt"`    // 十六进制，使用密钥文件时全为0
+	Created time.Time `json:"created"` // 启用加密的时间，之前上传的未加密对象仍可以读取
+	MAC     string    `json:"mac"`     // 主密钥对以上内容的认证码，口令或密钥文件错误时也不匹配
+}
+
+// 仓库盐对象的名称
+func repositorySaltName(config Config) string {
+	return "keys/" + config.BackupPrefix + repositorySaltSuffix
+}
+
+// LoadRepositorySalt 读取仓库的盐对象，使用口令时从口令派生主密钥，并验证盐对象的认证码
+// 仓库中没有盐对象时（首次启用加密）生成随机的盐并保存到仓库中，使用密钥文件时盐全为0
+func (e *Encryptor) LoadRepositorySalt(config Config, blobs BlobStorage) error {
+	if e == nil {
+		return nil
+	}
+
+	name := repositorySaltName(config)
+	stored, err := readRepositorySalt(blobs, name)
+	if err != nil {
+		return fmt.Errorf("failed to read encryption salt %s: %v", name, err)
+	}
+
+	if stored == nil {
+		salt := make([]byte, encryptionSaltSize)
+		if e.kdf == kdfScrypt {
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+		}
+		stored = &repositorySalt{KDF: e.kdfName(), Salt: hex.EncodeToString(salt), Created: time.Now().UTC()}
+		if err := e.useSalt(salt); err != nil {
+			return err
+		}
+		stored.MAC = e.repositoryMAC(stored)
+		log.Printf("Generated a new encryption salt in %s", name)
+
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		if err := blobs.PutBlob(name, bytes.NewReader(data), int64(len(data))); err != nil {
+			return fmt.Errorf("failed to write encryption salt %s: %v", name, err)
+		}
+	}
+
+	if stored.KDF != e.kdfName() {
+		return fmt.Errorf("repository was set up with %s encryption (%s), but %s is configured", stored.KDF, name, e.kdfName())
+	}
+	salt, _ := hex.DecodeString(stored.Salt)
+	if err := e.useSalt(salt); err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(stored.MAC), []byte(e.repositoryMAC(stored))) {
+		return fmt.Errorf("ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE does not match the repository (or %s was modified)", name)
+	}
+	e.since = stored.Created
+	return nil
+}
+
+// 使用仓库的盐，口令派生的主密钥随盐改变，密钥文件的主密钥不需要盐
+func (e *Encryptor) useSalt(salt []byte) error {
+	if e.kdf != kdfScrypt {
+		return nil
+	}
+	key, err := e.deriveKey(salt)
+	if err != nil {
+		return err
+	}
+	e.setMasterKey(salt, key)
+	return nil
+}
+
+// 盐对象内容的认证码
+func (e *Encryptor) repositoryMAC(stored *repositorySalt) string {
+	mac := hmac.New(sha256.New, e.masterKey)
+	mac.Write([]byte("repository\x00" + stored.KDF + "\x00" + stored.Salt + "\x00" + stored.Created.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 读取仓库盐对象，不存在时返回 nil
+func readRepositorySalt(blobs BlobStorage, name string) (*repositorySalt, error) {
+	files, err := blobs.ListBlobs(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := files[name]; !exists {
+		return nil, nil
+	}
+
+	reader, err := blobs.GetBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	stored := &repositorySalt{}
+	if err := json.NewDecoder(reader).Decode(stored); err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(stored.Salt)
+	if err != nil || len(salt) != encryptionSaltSize || stored.Created.IsZero() || stored.MAC == "" {
+		return nil, fmt.Errorf("invalid salt object")
+	}
+	return stored, nil
+}
+
+// 设置主密钥和对应的盐，并派生文件名加密的子密钥
+func (e *Encryptor) setMasterKey(salt, key []byte) {
+	e.salt = salt
+	e.masterKey = key
+	if e.encryptNames {
+		e.nameKey = e.subkey("name key")
+		e.nameMACKey = e.subkey("name mac key")
+	}
+}
+
+// Params 返回记录在对象元数据中的加密参数，未启用加密时为空
+func (e *Encryptor) Params() string {
+	if e == nil {
+		return ""
+	}
+	return fmt.Sprintf("v%d/aes-256-gcm/%s/%dk", encryptionVersion, e.kdfName(), encryptionChunkSize/1024)
+}
+
+// 密钥派生方式的名称
+func (e *Encryptor) kdfName() string {
+	if e.kdf == kdfScrypt {
+		return "scrypt"
+	}
+	return "keyfile"
+}
+
+// UploadReader 返回加密后的内容和大小，未启用加密时原样返回，每次调用使用新的随机文件随机数
+func (e *Encryptor) UploadReader(r io.Reader, size int64) (io.Reader, int64) {
+	return e.UploadReaderWithNonce(r, size, e.NewFileNonce())
+}
+
+// NewFileNonce 生成随机的文件随机数，未启用加密时返回 nil
+func (e *Encryptor) NewFileNonce() []byte {
+	if e == nil {
+		return nil
+	}
+	fileNonce := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(fileNonce); err != nil {
+		panic(err) // 系统随机数源不可用时无法安全加密
+	}
+	return fileNonce
+}
+
+// UploadReaderWithNonce 使用指定的文件随机数加密，只用于续传同一内容的大文件，使续传的分片与之前上传的一致
+func (e *Encryptor) UploadReaderWithNonce(r io.Reader, size int64, fileNonce []byte) (io.Reader, int64) {
+	if e == nil {
+		return r, size
+	}
+	if len(fileNonce) != encryptionNonceSize {
+		fileNonce = e.NewFileNonce()
+	}
+
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion, cipherAES256GCM, e.kdf)
+	header = binary.BigEndian.AppendUint32(header, encryptionChunkSize)
+	header = append(header, e.salt...)
+	header = append(header, fileNonce...)
+
+	return &encryptReader{
+		src:    bufio.NewReader(r),
+		aead:   fileCipher(e.masterKey, fileNonce),
+		header: header,
+		out:    header,
+		chunk:  make([]byte, encryptionChunkSize),
+	}, e.UploadSize(size)
+}
+
+// UploadSize 返回上传内容的大小（加密后增加头部和每块的认证标签）
+func (e *Encryptor) UploadSize(size int64) int64 {
+	if e == nil {
+		return size
+	}
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptionHeaderSize) + size + chunks*encryptionTagSize
+}
+
+// ChecksumTag 返回记录在远程元数据中的校验和，启用加密时使用带密钥的摘要，避免泄露明文的SHA1
+func (e *Encryptor) ChecksumTag(checksum string) string {
+	if e == nil {
+		return checksum
+	}
+	mac := hmac.New(sha256.New, e.masterKey)
+	mac.Write([]byte("checksum\x00" + checksum))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DownloadReader 返回解密后的内容，encrypted 表示对象（按元数据或头部）是加密的，uploaded 为对象的上传时间
+// 未加密的内容只有在启用加密之前上传时才原样返回，加密的内容必须以加密头部开始
+func (e *Encryptor) DownloadReader(r io.Reader, encrypted bool, uploaded time.Time) (io.Reader, error) {
+	if !encrypted {
+		if e != nil && !uploaded.Before(e.since) {
+			return nil, fmt.Errorf("content is not encrypted but was uploaded after encryption was enabled (%s), refusing it", e.since.Format(time.RFC3339))
+		}
+		return r, nil
+	}
+	if e == nil {
+		return nil, fmt.Errorf("content is encrypted but neither ENCRYPTION_PASSPHRASE nor ENCRYPTION_KEY_FILE is configured")
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("truncated encryption header: %v", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("missing encryption header")
+	}
+
+	pos := len(encryptionMagic)
+	version, algorithm, kdf := header[pos], header[pos+1], header[pos+2]
+	chunkSize := binary.BigEndian.Uint32(header[pos+3:])
+	salt := header[pos+7 : pos+7+encryptionSaltSize]
+	fileNonce := header[pos+7+encryptionSaltSize:]
+	if version != encryptionVersion || algorithm != cipherAES256GCM {
+		return nil, fmt.Errorf("unsupported encryption format (version %d, cipher %d)", version, algorithm)
+	}
+	if chunkSize == 0 || chunkSize > 16*1024*1024 {
+		return nil, fmt.Errorf("invalid encryption chunk size %d", chunkSize)
+	}
+
+	masterKey, err := e.masterKeyFor(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		src:    br,
+		aead:   fileCipher(masterKey, fileNonce),
+		header: header,
+		chunk:  make([]byte, int(chunkSize)+encryptionTagSize),
+	}, nil
+}
+
+// 获取加密对象使用的主密钥
+func (e *Encryptor) masterKeyFor(kdf byte, salt []byte) ([]byte, error) {
+	if kdf == e.kdf && bytes.Equal(salt, e.salt) {
+		return e.masterKey, nil
+	}
+	if kdf != kdfScrypt || e.kdf != kdfScrypt {
+		return nil, fmt.Errorf("content was encrypted with a different kind of key")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if key, ok := e.keys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := e.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	e.keys[string(salt)] = key
+	return key, nil
+}
+
+// 由主密钥派生指定用途的子密钥
+func (e *Encryptor) subkey(purpose string) []byte {
+	mac := hmac.New(sha256.New, e.masterKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// 从口令派生主密钥
+func (e *Encryptor) deriveKey(salt []byte) ([]byte, error) {
+	return scrypt.Key(e.passphrase, salt, scryptN, scryptR, scryptP, 32)
+}
+
+// 由主密钥和文件随机数派生文件密钥并创建 AES-256-GCM 实例
+func fileCipher(masterKey, fileNonce []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("file key\x00"))
+	mac.Write(fileNonce)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		panic(err) // 密钥长度固定为32字节，不会出错
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// 块的nonce：前8字节为块序号，最后一字节标记是否为最后一块
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// 读取一块数据，返回读取的字节数以及是否为最后一块
+func readChunk(src *bufio.Reader, chunk []byte) (int, bool, error) {
+	n, err := io.ReadFull(src, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+
+	// 刚好读满时需要再看一个字节才能确定是否为最后一块
+	if _, err := src.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// encryptReader 流式加密读取器
+type encryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	out     []byte // 待输出的密文
+	chunk   []byte
+	sealed  []byte
+	counter uint64
+	done    bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, last, err := readChunk(r.src, r.chunk)
+		if err != nil {
+			return 0, err
+		}
+		r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.counter, last), r.chunk[:n], r.header)
+		r.out = r.sealed
+		r.counter++
+		r.done = last
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptReader 流式解密读取器
+type decryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	out     []byte // 待输出的明文
+	chunk   []byte
+	opened  []byte
+	counter uint64
+	done    bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, last, err := readChunk(r.src, r.chunk)
+		if err != nil {
+			return 0, err
+		}
+		if n < encryptionTagSize {
+			return 0, errors.New("decryption failed: truncated content")
+		}
+		r.opened, err = r.aead.Open(r.opened[:0], chunkNonce(r.counter, last), r.chunk[:n], r.header)
+		if err != nil {
+			return 0, errors.New("decryption failed: wrong key or corrupted content")
+		}
+		r.out = r.opened
+		r.counter++
+		r.done = last
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 创建使用口令加密的本地存储配置
+func newEncryptedTestConfig(t *testing.T) Config {
+	t.Helper()
+	config := newTestConfig(t)
+	config.EncryptionPassphrase = "correct horse battery staple"
+	config.EncryptFileNames = true
+	return config
+}
+
+// 加密并读出全部内容
+func encryptBytes(t *testing.T, encryptor *Encryptor, data []byte) []byte {
+	t.Helper()
+	content, size := encryptor.UploadReader(bytes.NewReader(data), int64(len(data)))
+	sealed, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sealed)) != size {
+		t.Fatalf("encrypted size %d, want %d", len(sealed), size)
+	}
+	return sealed
+}
+
+// 相同内容每次加密使用不同的文件随机数，解密结果一致
+func TestEncryptorRandomFileNonce(t *testing.T) {
+	config := newEncryptedTestConfig(t)
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	encryptor := encryptorOf(storage)
+
+	data := []byte("same content")
+	first, second := encryptBytes(t, encryptor, data), encryptBytes(t, encryptor, data)
+	if bytes.Equal(first, second) {
+		t.Fatal("encrypting the same content twice produced identical ciphertext")
+	}
+	for _, sealed := range [][]byte{first, second} {
+		content, err := encryptor.DownloadReader(bytes.NewReader(sealed), true, time.Time{})
+		if err != nil {
+			t.Fatalf("DownloadReader: %v", err)
+		}
+		plain, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Fatalf("decrypted %q, want %q", plain, data)
+		}
+	}
+}
+
+// 仓库使用随机的盐并保存在仓库中，重新打开时使用同一个盐
+func TestRepositorySalt(t *testing.T) {
+	config := newEncryptedTestConfig(t)
+	legacy := sha256.Sum256([]byte("b2-go encryption salt\x00" + config.BackupPrefix))
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := encryptorOf(storage).salt
+	storage.Close()
+	if bytes.Equal(salt, legacy[:encryptionSaltSize]) {
+		t.Fatal("repository uses the prefix-derived salt")
+	}
+
+	reopened, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if !bytes.Equal(encryptorOf(reopened).salt, salt) {
+		t.Fatal("reopened repository uses a different salt")
+	}
+}
+
+// 配置了密钥时只接受启用加密之前上传的未加密对象，之后出现的未加密对象（被替换的内容）拒绝恢复
+func TestEncryptionRefusesUnencryptedContent(t *testing.T) {
+	config := newTestConfig(t)
+	writeTestFile(t, config.SourceDir, "old.txt", "legacy content")
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &LocalState{Files: make(map[string]*FileState)}
+	runTestBackup(t, config, storage, state)
+	storage.Close()
+	oldPath := filepath.Join(config.LocalStorageDir, filepath.FromSlash(config.BackupPrefix), "old.txt")
+	uploaded := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(oldPath, uploaded, uploaded); err != nil {
+		t.Fatal(err)
+	}
+
+	config.EncryptionPassphrase = "correct horse battery staple"
+	writeTestFile(t, config.SourceDir, "new.txt", "new content")
+	encrypted, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encrypted.Close()
+	runTestBackup(t, config, encrypted, state)
+
+	target := filepath.Join(t.TempDir(), "restore")
+	stats, err := NewRestorer(config, encrypted, state).Restore(RestoreOptions{TargetDir: target, Overwrite: OverwriteSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["restored"] != 2 || stats["failed"] != 0 {
+		t.Fatalf("restore stats %v", stats)
+	}
+	checkRestoredFiles(t, target, map[string]string{"old.txt": "legacy content", "new.txt": "new content"})
+
+	// 用未加密的内容替换加密的对象
+	newPath := filepath.Join(config.LocalStorageDir, filepath.FromSlash(config.BackupPrefix), "new.txt")
+	if err := os.WriteFile(newPath, []byte(localMetaMagic+"{}\nnew content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target = filepath.Join(t.TempDir(), "restore")
+	stats, err = NewRestorer(config, encrypted, state).Restore(RestoreOptions{TargetDir: target, Overwrite: OverwriteSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["restored"] != 1 || stats["failed"] != 1 {
+		t.Fatalf("restore stats after replacing the encrypted object %v, want 1 restored and 1 failed", stats)
+	}
+
+	config.EncryptionPassphrase = "wrong passphrase"
+	if wrong, err := NewStorage(config); err == nil {
+		wrong.Close()
+		t.Fatal("opening the repository with a wrong passphrase succeeded")
+	}
+}
@@ -3,100 +3,301 @@ package main
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 )
 
+// 扫描模式
+const (
+	ScanModeFast = "fast" // 大小和修改时间未变的已备份文件不重新计算校验和
+	ScanModeFull = "full" // 每次都计算所有文件的校验和
+)
+
+// ScanError 扫描时无法读取的路径
+type ScanError struct {
+	Path string // 相对于源目录的路径
+	Err  error
+}
+
 // FileScanner 文件扫描器结构体
 type FileScanner struct {
-	config Config
+	config   Config
+	fullHash bool // 本次扫描是否计算所有文件的校验和
+
+	mu            sync.Mutex
+	scanErrors    []ScanError // 本次扫描中无法读取的路径
+	modifiedFiles int         // 本次扫描中内容发生变化的已备份文件数
 }
 
 // NewFileScanner 创建新的文件扫描器实例
 func NewFileScanner(config Config) *FileScanner {
 	return &FileScanner{
-		config: config,
+		config:   config,
+		fullHash: config.ScanMode == ScanModeFull,
 	}
 }
 
+// SetFullHash 设置本次扫描是否计算所有文件的校验和（用于定期的完整校验）
+func (fs *FileScanner) SetFullHash(fullHash bool) {
+	fs.fullHash = fullHash
+}
+
+// FullHashDue 检查按 FULL_SCAN_INTERVAL 本次运行是否应进行完整校验
+func (fs *FileScanner) FullHashDue(state *LocalState) bool {
+	if fs.config.ScanMode == ScanModeFull {
+		return true
+	}
+	interval := fs.config.FullScanInterval
+	return interval > 0 && state.FastScansSinceFullScan >= interval-1
+}
+
+// 扫描和计算校验和流水线中的队列长度
+const scanQueueSize = 256
+
+// 扫描到的文件条目
+type scanEntry struct {
+	path    string
+	relPath string
+	info    os.FileInfo
+}
+
+// 文件条目的扫描结果
+type scanResult struct {
+	scanEntry
+	checksum string // 快速模式下跳过计算时为空
+	err      error  // 计算校验和时的错误
+}
+
 // ScanAndCompareFiles 扫描本地文件并与状态比较
+// 目录遍历和校验和计算并发进行，返回的变更列表按路径排序，与并发度无关
+// 无法读取的路径记录在 ScanErrors 中并继续扫描，数量超过 MAX_SCAN_ERRORS 时返回错误
 func (fs *FileScanner) ScanAndCompareFiles(state *LocalState) ([]*FileState, error) {
-	var changedFiles []*FileState
+	fs.scanErrors = nil
+	fs.modifiedFiles = 0
 
-	err := filepath.Walk(fs.config.SourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	results, err := fs.scanFiles(state)
+	if err != nil {
+		return nil, err
+	}
 
-		// 跳过目录
-		if info.IsDir() {
-			return nil
+	var changedFiles []*FileState
+	for _, result := range results {
+		if fileState := fs.compareFile(state, result); fileState != nil {
+			changedFiles = append(changedFiles, fileState)
 		}
+	}
 
-		relPath, err := filepath.Rel(fs.config.SourceDir, path)
-		if err != nil {
-			return err
-		}
+	// 记录完整校验的时间，用于计算下一次完整校验
+	if fs.fullHash {
+		state.LastFullScan = time.Now()
+		state.FastScansSinceFullScan = 0
+	} else {
+		state.FastScansSinceFullScan++
+	}
 
-		// 应用排除规则
-		if isExcluded(relPath, fs.config.ExcludePatterns) {
-			return nil
-		}
+	if count := len(fs.scanErrors); fs.config.MaxScanErrors >= 0 && count > fs.config.MaxScanErrors {
+		return nil, fmt.Errorf("%d paths could not be read, exceeding MAX_SCAN_ERRORS=%d", count, fs.config.MaxScanErrors)
+	}
 
-		// 检查文件是否在状态中
-		existing, exists := state.Files[relPath]
-		
-		// 计算新文件的校验和
-		checksum, err := fs.fileChecksum(path)
-		if err != nil {
-			log.Printf("Error calculating checksum for %s: %v", path, err)
-			return nil
-		}
-		
-		// 检查文件是否修改
-		modified := !exists || 
-			info.ModTime().After(existing.ModTime) || 
-			info.Size() != existing.Size ||
-			checksum != existing.Checksum
-		
-		if !modified {
-			// 文件未修改，标记为已备份
-			existing.BackedUp = true
-			log.Printf("File %s unchanged, skipping", relPath)
-			return nil
-		}
+	return changedFiles, nil
+}
+
+// ModifiedCount 返回最近一次扫描中内容发生变化的已备份文件数（不包括新文件）
+func (fs *FileScanner) ModifiedCount() int {
+	return fs.modifiedFiles
+}
+
+// ScanErrors 返回最近一次扫描中无法读取的路径，按路径排序
+func (fs *FileScanner) ScanErrors() []ScanError {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	scanErrors := append([]ScanError(nil), fs.scanErrors...)
+	sort.Slice(scanErrors, func(i, j int) bool {
+		return scanErrors[i].Path < scanErrors[j].Path
+	})
+	return scanErrors
+}
+
+// 记录无法读取的路径，扫描期间文件被删除不算错误（可能被多个协程并发调用）
+func (fs *FileScanner) recordScanError(path string, err error) {
+	relPath, relErr := filepath.Rel(fs.config.SourceDir, path)
+	if relErr != nil {
+		relPath = path
+	}
+
+	if os.IsNotExist(err) {
+		log.Printf("File %s disappeared during scan, skipping", relPath)
+		return
+	}
+
+	log.Printf("Warning: Cannot read %s: %v", relPath, err)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.scanErrors = append(fs.scanErrors, ScanError{Path: relPath, Err: err})
+}
+
+// 并发遍历源目录并计算校验和，结果按路径排序
+// 扫描期间只读取状态，状态的修改在全部结果返回后由 compareFile 按顺序进行
+func (fs *FileScanner) scanFiles(state *LocalState) ([]*scanResult, error) {
+	entries := make(chan scanEntry, scanQueueSize)
+	results := make(chan *scanResult, scanQueueSize)
 
-		// 如果文件存在但校验和相同，说明只是元数据变化
-		if exists && checksum == existing.Checksum {
-			// 文件内容未改变，只是元数据变化（如修改时间）
-			existing.ModTime = info.ModTime()
-			existing.Size = info.Size()
-			existing.BackedUp = true
-			log.Printf("File %s content unchanged, only metadata updated", relPath)
+	// 遍历目录，将需要检查的文件交给校验和计算协程
+	var walkErr error
+	go func() {
+		defer close(entries)
+		walker := newParallelWalker(scanWalkConcurrency)
+		walkErr = walker.Walk(fs.config.SourceDir, func(path string, info os.FileInfo) error {
+			relPath, err := filepath.Rel(fs.config.SourceDir, path)
+			if err != nil {
+				return err
+			}
+
+			// 应用排除规则
+			if isExcluded(relPath, fs.config.ExcludePatterns) {
+				return nil
+			}
+
+			entries <- scanEntry{path: path, relPath: relPath, info: info}
 			return nil
-		}
+		}, func(dir string) bool {
+			// 匹配排除规则的目录整个跳过，不读取其中的内容
+			relPath, err := filepath.Rel(fs.config.SourceDir, dir)
+			return err == nil && isExcluded(relPath, fs.config.ExcludePatterns)
+		}, fs.recordScanError)
+	}()
 
-		// 创建新的文件状态
-		fileState := &FileState{
-			Path:     relPath,
-			Size:     info.Size(),
-			ModTime:  info.ModTime(),
-			Checksum: checksum,
-			BackedUp: false, // 需要备份
-		}
+	// 固定数量的协程计算校验和
+	var wg sync.WaitGroup
+	for i := 0; i < fs.hashConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				results <- fs.hashFile(state, entry)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-		// 添加到状态和变更列表
-		state.Files[relPath] = fileState
-		changedFiles = append(changedFiles, fileState)
-		
-		log.Printf("File %s changed (size: %d, checksum: %s), will upload", relPath, info.Size(), checksum[:8])
+	var scanned []*scanResult
+	for result := range results {
+		scanned = append(scanned, result)
+	}
+	if walkErr != nil {
+		return nil, walkErr
+	}
 
-		return nil
+	sort.Slice(scanned, func(i, j int) bool {
+		return scanned[i].relPath < scanned[j].relPath
 	})
+	return scanned, nil
+}
+
+// 计算单个文件的校验和，快速模式下大小和修改时间未变的已备份文件不计算
+func (fs *FileScanner) hashFile(state *LocalState, entry scanEntry) *scanResult {
+	result := &scanResult{scanEntry: entry}
+	if !fs.fullHash && metadataMatches(state.Files[entry.relPath], entry.info) {
+		return result
+	}
+
+	result.checksum, result.err = fs.fileChecksum(entry.path)
+	return result
+}
+
+// 将扫描结果与状态比较并更新状态，文件需要上传时返回新的文件状态
+func (fs *FileScanner) compareFile(state *LocalState, result *scanResult) *FileState {
+	relPath, info, checksum := result.relPath, result.info, result.checksum
+
+	// 检查文件是否在状态中
+	existing, exists := state.Files[relPath]
+	unchangedMetadata := metadataMatches(existing, info)
+
+	// 快速模式：大小和修改时间都与状态一致的已备份文件直接信任，不重新计算校验和
+	if unchangedMetadata && !fs.fullHash {
+		log.Printf("File %s unchanged (size and mtime match), skipping", relPath)
+		return nil
+	}
+
+	if result.err != nil {
+		fs.recordScanError(result.path, result.err)
+		return nil
+	}
+
+	// 完整校验时发现大小和修改时间都没变但内容变了的文件
+	if unchangedMetadata && checksum != existing.Checksum {
+		log.Printf("Warning: File %s content changed without size or mtime change", relPath)
+	}
+
+	// 检查文件是否修改（上次未成功备份的文件需要重新上传）
+	modified := !exists ||
+		!existing.BackedUp ||
+		info.ModTime().After(existing.ModTime) ||
+		info.Size() != existing.Size ||
+		checksum != existing.Checksum
+
+	if !modified {
+		// 文件未修改，标记为已备份
+		existing.BackedUp = true
+		log.Printf("File %s unchanged, skipping", relPath)
+		return nil
+	}
+
+	// 如果文件存在但校验和相同，说明只是元数据变化
+	if exists && existing.BackedUp && checksum == existing.Checksum {
+		// 文件内容未改变，只是元数据变化（如修改时间）
+		existing.ModTime = info.ModTime()
+		existing.Size = info.Size()
+		existing.BackedUp = true
+		state.markDirty(relPath)
+		log.Printf("File %s content unchanged, only metadata updated", relPath)
+		return nil
+	}
+
+	// 创建新的文件状态
+	fileState := &FileState{
+		Path:     relPath,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Checksum: checksum,
+		BackedUp: false, // 需要备份
+	}
+
+	// 添加到状态
+	if exists && existing.BackedUp {
+		fs.modifiedFiles++
+	}
+	state.Files[relPath] = fileState
+	state.markDirty(relPath)
 
-	return changedFiles, err
+	log.Printf("File %s changed (size: %d, checksum: %s), will upload", relPath, info.Size(), checksum[:8])
+
+	return fileState
+}
+
+// 检查已备份文件的大小和修改时间是否与状态一致
+func metadataMatches(existing *FileState, info os.FileInfo) bool {
+	return existing != nil && existing.BackedUp &&
+		info.Size() == existing.Size && info.ModTime().Equal(existing.ModTime)
+}
+
+// 并发计算校验和的协程数，未配置时使用CPU核数
+func (fs *FileScanner) hashConcurrency() int {
+	if fs.config.HashConcurrency > 0 {
+		return fs.config.HashConcurrency
+	}
+	return runtime.NumCPU()
 }
 
 // FindDeletedFiles 查找已删除的文件
@@ -5,4 +5,21 @@ go 1.21
 require (
 	github.com/Backblaze/blazer v0.7.2
 	github.com/joho/godotenv v1.5.1
-) 
\ No newline at end of file
+	github.com/klauspost/compress v1.17.6
+	github.com/minio/minio-go/v7 v7.0.70
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.21.0
+	golang.org/x/sys v0.18.0
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/goccy/go-json v0.10.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/minio/md5-simd v1.1.2 // indirect
+	github.com/rs/xid v1.5.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	gopkg.in/ini.v1 v1.67.0 // indirect
+)
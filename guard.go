@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SafetyGuard 大量删除和大量变化保护
+// 源目录未挂载或被清空时会删除大量远程文件，勒索软件加密文件后会重新上传所有文件，
+// 这两种情况都应该在上传和删除之前中止运行
+type SafetyGuard struct {
+	config Config
+}
+
+// NewSafetyGuard 创建新的安全保护实例
+func NewSafetyGuard(config Config) *SafetyGuard {
+	return &SafetyGuard{
+		config: config,
+	}
+}
+
+// Check 检查本次运行将删除和修改的文件数量，超过任一阈值时返回说明原因的错误
+// backedUp 为扫描前已备份的文件数，modified 为其中内容发生变化的文件数；首次备份不做检查
+func (g *SafetyGuard) Check(backedUp, modified, deleted int) error {
+	if backedUp == 0 {
+		return nil
+	}
+
+	var violations []string
+	if g.config.MaxDeleteCount > 0 && deleted > g.config.MaxDeleteCount {
+		violations = append(violations, fmt.Sprintf("%d files would be deleted, exceeding MAX_DELETE_COUNT=%d",
+			deleted, g.config.MaxDeleteCount))
+	}
+	if percent := percentOf(deleted, backedUp); g.config.MaxDeletePercent > 0 && percent > float64(g.config.MaxDeletePercent) {
+		violations = append(violations, fmt.Sprintf("%d of %d backed-up files (%.1f%%) would be deleted, exceeding MAX_DELETE_PERCENT=%d",
+			deleted, backedUp, percent, g.config.MaxDeletePercent))
+	}
+	if percent := percentOf(modified, backedUp); g.config.MaxChangedPercent > 0 && percent > float64(g.config.MaxChangedPercent) {
+		violations = append(violations, fmt.Sprintf("%d of %d backed-up files (%.1f%%) changed, exceeding MAX_CHANGED_PERCENT=%d",
+			modified, backedUp, percent, g.config.MaxChangedPercent))
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("%s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// 统计状态中已备份的文件数
+func countBackedUp(state *LocalState) int {
+	count := 0
+	for _, fileState := range state.Files {
+		if fileState.BackedUp {
+			count++
+		}
+	}
+	return count
+}
+
+// 计算百分比
+func percentOf(n, total int) float64 {
+	return float64(n) * 100 / float64(total)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 上传过程中使用的临时文件后缀
+const localUploadSuffix = ".b2upload"
+
+// 本地目录没有对象元数据，存储的文件以元数据头部开始：魔数之后是一行JSON，
+// 记录与B2/S3对象元数据相同的信息（加密参数、压缩算法），之后是对象内容
+const localMetaMagic = "B2GOMETA\n"
+
+// LocalStorage 本地目录存储结构体，用于备份到NAS挂载点或离线测试
+// 本地目录不保留历史版本，每个路径只有最新的一份
+type LocalStorage struct {
+	root       string // BACKUP_PREFIX 对应的本地目录
+	config     Config
+	encryptor  *Encryptor  // 客户端加密，为空表示不加密
+	compressor *Compressor // 上传前压缩，为空表示不压缩
+}
+
+var (
+	_ Storage        = (*LocalStorage)(nil)
+	_ BlobStorage    = (*LocalStorage)(nil)
+	_ OptionUploader = (*LocalStorage)(nil)
+)
+
+// NewLocalStorage 创建新的本地目录存储实例，encryptor 为空时不加密，compressor 为空时不压缩
+func NewLocalStorage(config Config, encryptor *Encryptor, compressor *Compressor) (*LocalStorage, error) {
+	root := filepath.Join(config.LocalStorageDir, filepath.FromSlash(config.BackupPrefix))
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalStorage{
+		root:       root,
+		config:     config,
+		encryptor:  encryptor,
+		compressor: compressor,
+	}, nil
+}
+
+// UploadFile 复制文件到存储目录
+func (l *LocalStorage) UploadFile(localPath, remotePath, checksum string) error {
+	return l.UploadFileWithOptions(localPath, remotePath, checksum, UploadOptions{})
+}
+
+// UploadFileWithOptions 按选项复制文件，Force 时不检查存储目录中是否已存在相同文件
+func (l *LocalStorage) UploadFileWithOptions(localPath, remotePath, checksum string, opts UploadOptions) error {
+	targetPath := l.path(remotePath)
+
+	// 与B2后端保持一致的重复检测策略
+	if info, err := os.Stat(targetPath); err == nil && !opts.Force {
+		shouldSkip := false
+
+		switch l.config.MetadataStrategy {
+		case "full":
+			// 本地文件可以直接计算（解密后内容的）校验和，不需要元数据文件
+			if l.config.EnableMetadataCheck {
+				if storedChecksum, err := l.storedChecksum(targetPath); err == nil && storedChecksum == checksum {
+					log.Printf("File %s has same checksum (full check), skipping upload", remotePath)
+					shouldSkip = true
+				}
+			}
+		case "none":
+			log.Printf("File %s will be uploaded (no duplicate check)", remotePath)
+		default:
+			// 压缩文件的大小与原文件无关，不能比较
+			if localInfo, err := os.Stat(localPath); err == nil {
+				if stored, err := openLocalObject(targetPath); err == nil {
+					stored.Close()
+					if stored.Info[compressionInfoKey] == "" && l.encryptor.UploadSize(localInfo.Size()) == info.Size()-stored.headerSize {
+						log.Printf("File %s has same size (basic check), skipping upload", remotePath)
+						shouldSkip = true
+					}
+				}
+			}
+		}
+
+		if shouldSkip {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	compressed, err := l.compressor.Compress(src, remotePath, srcInfo.Size())
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	content, _ := l.encryptor.UploadReader(compressed, compressed.Size)
+
+	// 在元数据头部中记录压缩算法和加密参数
+	info := make(map[string]string)
+	for key, value := range opts.Info {
+		info[key] = value
+	}
+	if params := l.encryptor.Params(); params != "" {
+		info[encryptionInfoKey] = params
+	}
+	if compressed.Algorithm != "" {
+		info[compressionInfoKey] = compressed.Algorithm
+	}
+	header, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名，避免留下不完整的文件
+	tmpPath := targetPath + localUploadSuffix
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(dst, "%s%s\n", localMetaMagic, header)
+	if err == nil {
+		_, err = io.Copy(dst, content)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, targetPath)
+}
+
+// DeleteFile 删除存储目录中的文件
+func (l *LocalStorage) DeleteFile(file *RemoteFile) error {
+	return os.Remove(l.filePath(file))
+}
+
+// HideFile 本地目录不保留历史版本，隐藏等同于删除
+func (l *LocalStorage) HideFile(file *RemoteFile) error {
+	log.Printf("Warning: Local storage keeps no versions, %s is deleted permanently", file.Path)
+	return l.DeleteFile(file)
+}
+
+// GetFileList 获取存储目录中的全部文件
+func (l *LocalStorage) GetFileList() (map[string]*RemoteFile, error) {
+	return l.ListFiles("")
+}
+
+// GetFileAttrs 读取单个文件的元数据
+func (l *LocalStorage) GetFileAttrs(remotePath string) (*RemoteFile, error) {
+	info, err := os.Stat(l.path(remotePath))
+	if err != nil {
+		return nil, err
+	}
+	return l.remoteFile(remotePath, l.path(remotePath), info), nil
+}
+
+// ListFiles 列出指定相对路径（文件或目录前缀）下的文件
+func (l *LocalStorage) ListFiles(remotePath string) (map[string]*RemoteFile, error) {
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	fileMap := make(map[string]*RemoteFile)
+
+	err := filepath.Walk(l.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// 跳过目录和未完成的上传
+		if info.IsDir() || strings.HasSuffix(path, localUploadSuffix) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		relPath = l.encryptor.DecryptName(filepath.ToSlash(relPath))
+
+		if matchesRemotePath(relPath, remotePath) {
+			addListedFile(fileMap, relPath, l.remoteFile(relPath, path, info))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fileMap, nil
+}
+
+// ListFilesAsOf 本地目录不保留历史版本，只能返回在该时间点之前写入且仍然存在的文件
+func (l *LocalStorage) ListFilesAsOf(remotePath string, asOf time.Time) (map[string]*RemoteFile, error) {
+	files, err := l.ListFiles(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for relPath, file := range files {
+		if file.UploadTimestamp.After(asOf) {
+			log.Printf("Warning: %s was modified after %s and has no older version in local storage", relPath, asOf.Format(time.RFC3339))
+			delete(files, relPath)
+		}
+	}
+
+	return files, nil
+}
+
+// ListFileVersions 本地目录不保留历史版本，每个文件只有当前的一个版本
+func (l *LocalStorage) ListFileVersions(remotePath string) (map[string][]*RemoteFile, error) {
+	files, err := l.ListFiles(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string][]*RemoteFile)
+	for relPath, file := range files {
+		versions[relPath] = []*RemoteFile{file}
+	}
+
+	return versions, nil
+}
+
+// DownloadFile 复制存储目录中的文件到本地路径，返回解密后内容的SHA1校验和
+// 列表结果不读取元数据头部，下载时补全 file.Info
+func (l *LocalStorage) DownloadFile(file *RemoteFile, localPath string) (string, error) {
+	src, err := openLocalObject(l.filePath(file))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	file.Info = src.Info
+
+	checksum, encrypted, err := writeDownload(l.encryptor, src, localPath, fileFormat(src.Info, src.ModTime))
+	file.Encrypted = file.Encrypted || encrypted
+	return checksum, err
+}
+
+// PutBlob 写入 LOCAL_STORAGE_DIR 下指定名称的文件
+func (l *LocalStorage) PutBlob(name string, r io.Reader, size int64) error {
+	targetPath := l.blobPath(name)
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名，避免留下不完整的文件
+	tmpPath := targetPath + localUploadSuffix
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, targetPath)
+}
+
+// GetBlob 读取 LOCAL_STORAGE_DIR 下指定名称的文件
+func (l *LocalStorage) GetBlob(name string) (io.ReadCloser, error) {
+	return os.Open(l.blobPath(name))
+}
+
+// GetBlobRange 读取 LOCAL_STORAGE_DIR 下指定名称的文件中的一段内容
+func (l *LocalStorage) GetBlobRange(name string, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(l.blobPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// ListBlobs 列出 LOCAL_STORAGE_DIR 下指定前缀（目录）中的文件
+func (l *LocalStorage) ListBlobs(prefix string) (map[string]*RemoteFile, error) {
+	blobs := make(map[string]*RemoteFile)
+
+	err := filepath.Walk(l.blobPath(prefix), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, localUploadSuffix) {
+			return nil
+		}
+
+		name, err := filepath.Rel(l.config.LocalStorageDir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		blobs[name] = &RemoteFile{
+			Path:            name,
+			Size:            info.Size(),
+			UploadTimestamp: info.ModTime(),
+			Latest:          true,
+			handle:          path,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// DeleteBlob 删除文件
+func (l *LocalStorage) DeleteBlob(file *RemoteFile) error {
+	return os.Remove(l.blobPath(file.Path))
+}
+
+// 获取完整对象名对应的本地路径
+func (l *LocalStorage) blobPath(name string) string {
+	return filepath.Join(l.config.LocalStorageDir, filepath.FromSlash(name))
+}
+
+// Close 本地存储无需释放资源
+func (l *LocalStorage) Close() error {
+	return nil
+}
+
+// 获取相对路径对应的本地存储路径，启用文件名加密时使用加密后的名称
+func (l *LocalStorage) path(remotePath string) string {
+	return filepath.Join(l.root, filepath.FromSlash(l.encryptor.EncryptName(remotePath)))
+}
+
+// 获取远程文件的本地存储路径，列出的文件使用实际的路径（可能是启用文件名加密前写入的）
+func (l *LocalStorage) filePath(file *RemoteFile) string {
+	if path, ok := file.handle.(string); ok {
+		return path
+	}
+	return l.path(file.Path)
+}
+
+// 将本地文件信息转换为通用的远程文件信息
+func (l *LocalStorage) remoteFile(relPath, path string, info os.FileInfo) *RemoteFile {
+	return &RemoteFile{
+		Path:            relPath,
+		Size:            info.Size(),
+		UploadTimestamp: info.ModTime(),
+		Latest:          true,
+		handle:          path,
+	}
+}
+
+// 计算存储目录中文件解密后内容的SHA1校验和
+func (l *LocalStorage) storedChecksum(path string) (string, error) {
+	file, err := openLocalObject(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	content, _, err := openDownload(l.encryptor, file, fileFormat(file.Info, file.ModTime))
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// localObject 存储目录中的文件，读取位置在元数据头部之后
+type localObject struct {
+	*bufio.Reader
+	Info       map[string]string // 元数据头部中记录的信息
+	ModTime    time.Time         // 文件的修改时间，即写入存储目录的时间
+	headerSize int64             // 元数据头部的长度
+	file       *os.File
+}
+
+// 打开存储目录中的文件并读取元数据头部
+func openLocalObject(path string) (*localObject, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(localMetaMagic))
+	_, err = io.ReadFull(reader, magic)
+	if err == nil && string(magic) != localMetaMagic {
+		err = fmt.Errorf("missing metadata header")
+	}
+	var line []byte
+	if err == nil {
+		line, err = reader.ReadBytes('\n')
+	}
+	info := make(map[string]string)
+	if err == nil {
+		err = json.Unmarshal(line, &info)
+	}
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = file.Stat()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: invalid metadata header: %v", path, err)
+	}
+
+	return &localObject{
+		Reader:     reader,
+		Info:       info,
+		ModTime:    stat.ModTime(),
+		headerSize: int64(len(magic) + len(line)),
+		file:       file,
+	}, nil
+}
+
+// Close 关闭文件
+func (o *localObject) Close() error {
+	return o.file.Close()
+}
+
+// 计算文件SHA1校验和
+func fileSHA1(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
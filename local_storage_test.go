@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// 创建使用临时目录的本地存储配置
+func newTestConfig(t *testing.T) Config {
+	t.Helper()
+	dir := t.TempDir()
+	config := Config{
+		SourceDir:         filepath.Join(dir, "src"),
+		StorageBackend:    StorageBackendLocal,
+		LocalStorageDir:   filepath.Join(dir, "dst"),
+		LocalStatePath:    filepath.Join(dir, "state.json"),
+		MetadataStrategy:  "none",
+		ScanMode:          ScanModeFast,
+		UploadConcurrency: 2,
+		HashConcurrency:   2,
+		MaxScanErrors:     -1,
+		StateGenerations:  3,
+	}
+	applyConfigDefaults(&config)
+	if err := os.MkdirAll(config.SourceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// 在目录中写入测试文件
+func writeTestFile(t *testing.T, dir, relPath, content string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 扫描源目录并上传变化的文件，返回上传统计
+func runTestBackup(t *testing.T, config Config, storage Storage, state *LocalState) map[string]int {
+	t.Helper()
+	changed, err := NewFileScanner(config).ScanAndCompareFiles(state)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	stats := map[string]int{"uploaded": 0, "failed": 0}
+	NewUploader(config, storage, state).UploadFiles(changed, stats)
+	if stats["failed"] != 0 {
+		t.Fatalf("upload failed: %v", stats)
+	}
+	return stats
+}
+
+// 检查恢复目录中的文件内容
+func checkRestoredFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	for relPath, content := range want {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(relPath)))
+		if err != nil {
+			t.Errorf("restored %s: %v", relPath, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("restored %s = %q, want %q", relPath, data, content)
+		}
+	}
+}
+
+func TestLocalStoragePipeline(t *testing.T) {
+	modes := []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{"plain", func(*Config) {}},
+		{"encrypted-compressed", func(c *Config) {
+			c.EncryptionPassphrase = "correct horse battery staple"
+			c.EncryptFileNames = true
+			c.Compression = CompressionGzip
+		}},
+		{"chunked", func(c *Config) { c.RepositoryMode = RepositoryModeChunked }},
+		{"packed", func(c *Config) {
+			c.RepositoryMode = RepositoryModePacked
+			c.PackMaxFileSizeKB = 512
+			c.PackTargetSizeMB = 64
+		}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			mode.configure(&config)
+			testStoragePipeline(t, config)
+		})
+	}
+}
+
+// 在指定配置下执行备份、增量备份、恢复和保留策略清理的完整流程
+func testStoragePipeline(t *testing.T, config Config) {
+	t.Helper()
+	if err := validateStorageConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"a.txt":         "alpha",
+		"dir/b.txt":     "bravo bravo bravo",
+		"dir/sub/c.txt": "charlie",
+	}
+	for relPath, content := range files {
+		writeTestFile(t, config.SourceDir, relPath, content)
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	state := &LocalState{Files: make(map[string]*FileState)}
+
+	// 首次备份上传全部文件
+	if stats := runTestBackup(t, config, storage, state); stats["uploaded"] != len(files) {
+		t.Fatalf("first backup uploaded %d files, want %d", stats["uploaded"], len(files))
+	}
+	for relPath, fileState := range state.Files {
+		if !fileState.BackedUp {
+			t.Errorf("%s not marked as backed up", relPath)
+		}
+	}
+
+	// 没有变化时不上传，修改的文件重新上传
+	if stats := runTestBackup(t, config, storage, state); stats["uploaded"] != 0 {
+		t.Fatalf("unchanged backup uploaded %d files", stats["uploaded"])
+	}
+	files["dir/b.txt"] = "bravo changed"
+	writeTestFile(t, config.SourceDir, "dir/b.txt", files["dir/b.txt"])
+	if stats := runTestBackup(t, config, storage, state); stats["uploaded"] != 1 {
+		t.Fatalf("second backup uploaded %d files, want 1", stats["uploaded"])
+	}
+
+	remoteFiles, err := storage.GetFileList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remoteFiles) != len(files) {
+		t.Fatalf("remote has %d files, want %d", len(remoteFiles), len(files))
+	}
+
+	// 恢复到新目录，下载内容按本地状态中的校验和校验
+	target := filepath.Join(t.TempDir(), "restore")
+	stats, err := NewRestorer(config, storage, state).Restore(RestoreOptions{TargetDir: target, Overwrite: OverwriteSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["restored"] != len(files) || stats["failed"] != 0 {
+		t.Fatalf("restore stats %v", stats)
+	}
+	checkRestoredFiles(t, target, files)
+
+	// 本地删除的文件在保留期限过后被清理，仍存在的文件保留当前版本
+	if err := os.Remove(filepath.Join(config.SourceDir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRetentionManager(config, storage).ManageRetention(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开存储，确认清理结果已持久化
+	reopened, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	versions, err := reopened.ListFileVersions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := versions["a.txt"]; exists {
+		t.Errorf("a.txt still has versions after retention: %v", versions["a.txt"])
+	}
+	for _, relPath := range []string{"dir/b.txt", "dir/sub/c.txt"} {
+		if len(versions[relPath]) == 0 {
+			t.Errorf("%s lost its current version", relPath)
+		}
+	}
+	decisions, err := NewRetentionManager(config, reopened).PlanRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 0 {
+		t.Errorf("retention still plans %d deletions after pruning", len(decisions))
+	}
+}
+
+// 以压缩或加密头部的魔数开始的文件在未压缩、未加密上传后原样恢复
+func TestLocalStorageHeaderLikeContent(t *testing.T) {
+	files := map[string]string{
+		"zstd.bin": compressionMagic + "\x01\x02not really zstd",
+		"enc.bin":  encryptionMagic + "\x01\x01\x00not really encrypted",
+		"meta.bin": localMetaMagic + "{}\nnot really metadata",
+	}
+
+	for _, compression := range []string{CompressionNone, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			config := newTestConfig(t)
+			config.Compression = compression
+			for relPath, content := range files {
+				writeTestFile(t, config.SourceDir, relPath, content)
+			}
+
+			storage, err := NewStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+			state := &LocalState{Files: make(map[string]*FileState)}
+			runTestBackup(t, config, storage, state)
+
+			target := filepath.Join(t.TempDir(), "restore")
+			stats, err := NewRestorer(config, storage, state).Restore(RestoreOptions{TargetDir: target, Overwrite: OverwriteSkip})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats["restored"] != len(files) || stats["failed"] != 0 {
+				t.Fatalf("restore stats %v", stats)
+			}
+			checkRestoredFiles(t, target, files)
+		})
+	}
+}
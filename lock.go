@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lockSuffix = ".lock"
+
+// LockInfo 锁持有者的信息，写入本地锁文件和远程锁对象
+type LockInfo struct {
+	ID      string    `json:"id"`      // 运行ID，同一次运行刷新后的锁对象ID相同
+	Command string    `json:"command"` // 持有锁的命令，如 backup、prune
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	PIDNS   string    `json:"pid_ns,omitempty"` // 进程ID所属的命名空间，见 pidNamespace
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"` // 最近一次刷新的时间
+}
+
+// 持有者的描述，用于错误信息
+func (info *LockInfo) String() string {
+	if info.ID == "" {
+		return "unknown holder"
+	}
+	return fmt.Sprintf("%s (pid %d on %s, started %s)", info.Command, info.PID, info.Host, info.Started.Local().Format(time.RFC3339))
+}
+
+// 检查锁是否已过期：持有者在本机同一个进程ID命名空间中且进程已不存在，或超过 staleAfter 没有刷新（0表示不按时间判断）
+// 共享主机名的多个容器各有自己的进程ID命名空间，命名空间不同时进程ID不可比较，只按时间判断
+func (info *LockInfo) stale(age, staleAfter time.Duration) (bool, string) {
+	host, _ := os.Hostname()
+	if info.Host != "" && info.Host == host && info.PIDNS == pidNamespace() && info.PID > 0 && !processExists(info.PID) {
+		return true, fmt.Sprintf("process %d no longer exists", info.PID)
+	}
+	if staleAfter > 0 && age > staleAfter {
+		return true, fmt.Sprintf("not refreshed for %v", age.Round(time.Second))
+	}
+	return false, ""
+}
+
+// RunLock 运行锁，防止定时任务在上一次运行未结束时重叠运行
+// 本地锁是状态文件旁的锁文件（LOCAL_STATE_PATH.lock）上的文件锁，进程退出时由系统释放；
+// 远程锁（REMOTE_LOCK=true）是 LOCK_PREFIX 下的锁对象，用于多台主机备份到同一位置。
+// 持有期间定期刷新，远程锁对象由于进程被杀死等原因残留时，按主机、进程ID和刷新时间判断为过期后删除
+type RunLock struct {
+	config     Config
+	info       LockInfo
+	staleAfter time.Duration
+	path       string
+	file       *os.File
+	locked     bool // 是否持有文件锁，文件系统不支持文件锁时只依赖锁文件中的持有者信息
+
+	mu        sync.Mutex
+	blobs     BlobStorage
+	encryptor *Encryptor
+	remote    *RemoteFile // 当前的远程锁对象
+
+	stop     chan struct{}
+	done     chan struct{}
+	released bool
+}
+
+// AcquireRunLock 获取本地运行锁，其他运行正在进行时返回错误
+func AcquireRunLock(config Config, command string) (*RunLock, error) {
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	l := &RunLock{
+		config: config,
+		info: LockInfo{
+			ID:      newObjectID(),
+			Command: command,
+			Host:    host,
+			PID:     os.Getpid(),
+			PIDNS:   pidNamespace(),
+			Started: now,
+			Updated: now,
+		},
+		staleAfter: time.Duration(config.LockStaleMinutes) * time.Minute,
+		path:       config.LocalStatePath + lockSuffix,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %v", l.path, err)
+	}
+
+	locked, err := lockFile(file)
+	switch {
+	case err != nil:
+		// 文件系统不支持文件锁（如部分网络文件系统）时按锁文件中的持有者信息判断
+		log.Printf("Warning: Could not lock %s (%v), relying on the recorded lock holder", l.path, err)
+		if holder := l.readLocal(); holder != nil {
+			stale, reason := holder.stale(time.Since(holder.Updated), l.staleAfter)
+			if !stale {
+				file.Close()
+				return nil, fmt.Errorf("another run is active: %s holds %s", holder, l.path)
+			}
+			log.Printf("Taking over stale lock %s from %s: %s", l.path, holder, reason)
+		}
+	case !locked:
+		holder := l.readLocal()
+		if holder == nil {
+			holder = &LockInfo{}
+		}
+		file.Close()
+		return nil, fmt.Errorf("another run is active: %s holds %s", holder, l.path)
+	}
+
+	l.file = file
+	l.locked = locked
+	if err := l.writeLocal(); err != nil {
+		l.Release()
+		return nil, fmt.Errorf("failed to write lock file %s: %v", l.path, err)
+	}
+
+	// 按过期时间的三分之一刷新，持有期间锁不会被其他运行判断为过期
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.heartbeat()
+
+	return l, nil
+}
+
+// AcquireRemote 在存储后端中创建远程锁对象，未启用远程锁时不做任何操作
+// 先写入自己的锁对象再列出全部锁对象，存在其他未过期的锁时删除自己的锁对象并返回错误；
+// 两次运行同时获取时可能都失败，但不会都成功
+func (l *RunLock) AcquireRemote(storage Storage) error {
+	if !l.config.RemoteLock {
+		return nil
+	}
+	blobs, ok := blobStorageOf(storage)
+	if !ok {
+		return fmt.Errorf("storage backend %s does not support remote locks", l.config.StorageBackend)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.blobs = blobs
+	l.encryptor = encryptorOf(storage)
+	remote, err := l.writeRemote()
+	if err != nil {
+		l.blobs = nil
+		return fmt.Errorf("failed to create remote lock: %v", err)
+	}
+	l.remote = remote
+
+	locks, err := l.blobs.ListBlobs(l.config.LockPrefix)
+	if err != nil {
+		l.releaseRemote()
+		return fmt.Errorf("failed to list remote locks: %v", err)
+	}
+	for name, file := range locks {
+		if !strings.HasSuffix(name, lockSuffix) || name == remote.Path {
+			continue
+		}
+
+		holder, err := l.readRemote(file)
+		if err != nil {
+			log.Printf("Warning: Could not read remote lock %s: %v", name, err)
+			holder = &LockInfo{}
+		}
+		if holder.ID == l.info.ID {
+			continue
+		}
+
+		age := time.Since(holder.Updated)
+		if !file.UploadTimestamp.IsZero() {
+			age = time.Since(file.UploadTimestamp)
+		}
+		if stale, reason := holder.stale(age, l.staleAfter); stale {
+			log.Printf("Removing stale remote lock %s held by %s: %s", name, holder, reason)
+			if err := l.blobs.DeleteBlob(file); err != nil {
+				log.Printf("Warning: Could not remove stale remote lock %s: %v", name, err)
+			}
+			continue
+		}
+
+		l.releaseRemote()
+		return fmt.Errorf("another run is active: %s holds remote lock %s", holder, name)
+	}
+
+	log.Printf("Remote lock %s acquired", remote.Path)
+	return nil
+}
+
+// Release 释放远程锁和本地锁，可以重复调用
+func (l *RunLock) Release() {
+	if l.released {
+		return
+	}
+	l.released = true
+
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.mu.Lock()
+	l.releaseRemote()
+	l.mu.Unlock()
+
+	// 清空而不删除锁文件：删除后其他进程可能锁住不同的文件
+	l.file.Truncate(0)
+	if l.locked {
+		unlockFile(l.file)
+	}
+	l.file.Close()
+}
+
+// Fatalf 释放运行锁后记录错误并退出，l 为 nil 时直接退出
+// log.Fatalf 不执行 defer，持有锁时出错退出需调用此方法，避免远程锁对象残留到过期
+func (l *RunLock) Fatalf(format string, v ...interface{}) {
+	if l != nil {
+		l.Release()
+	}
+	log.Fatalf(format, v...)
+}
+
+// 定期刷新本地锁文件和远程锁对象，直到释放
+func (l *RunLock) heartbeat() {
+	defer close(l.done)
+	if l.staleAfter <= 0 {
+		<-l.stop
+		return
+	}
+
+	ticker := time.NewTicker(l.staleAfter / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.refresh()
+		}
+	}
+}
+
+// 刷新锁的时间，远程锁写入新的锁对象后删除之前的
+func (l *RunLock) refresh() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.info.Updated = time.Now().UTC()
+	if err := l.writeLocal(); err != nil {
+		log.Printf("Warning: Could not refresh lock file %s: %v", l.path, err)
+	}
+
+	if l.remote == nil {
+		return
+	}
+	remote, err := l.writeRemote()
+	if err != nil {
+		log.Printf("Warning: Could not refresh remote lock: %v", err)
+		return
+	}
+	if err := l.blobs.DeleteBlob(l.remote); err != nil {
+		log.Printf("Warning: Could not remove previous remote lock %s: %v", l.remote.Path, err)
+	}
+	l.remote = remote
+}
+
+// 删除当前的远程锁对象（调用方需持有 l.mu）
+func (l *RunLock) releaseRemote() {
+	if l.remote == nil {
+		return
+	}
+	if err := l.blobs.DeleteBlob(l.remote); err != nil {
+		log.Printf("Warning: Could not remove remote lock %s: %v", l.remote.Path, err)
+	}
+	l.remote = nil
+}
+
+// 把持有者信息写入本地锁文件
+func (l *RunLock) writeLocal() error {
+	data, err := json.Marshal(&l.info)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// 读取本地锁文件中的持有者信息，文件为空或无法解析时返回 nil
+func (l *RunLock) readLocal() *LockInfo {
+	data, err := os.ReadFile(l.path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	info := &LockInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// 上传一个新的远程锁对象，返回列表中的对象（删除时需要其版本信息）
+func (l *RunLock) writeRemote() (*RemoteFile, error) {
+	data, err := json.Marshal(&l.info)
+	if err != nil {
+		return nil, err
+	}
+
+	name := l.config.LockPrefix + newObjectID() + lockSuffix
+	data = storedBytes(data)
+	content, size := l.encryptor.UploadReader(bytes.NewReader(data), int64(len(data)))
+	if err := l.blobs.PutBlob(name, content, size); err != nil {
+		return nil, err
+	}
+
+	blobs, err := l.blobs.ListBlobs(name)
+	if err != nil {
+		return nil, err
+	}
+	remote, exists := blobs[name]
+	if !exists {
+		return nil, fmt.Errorf("lock object %s not found after upload", name)
+	}
+	return remote, nil
+}
+
+// 读取远程锁对象中的持有者信息
+func (l *RunLock) readRemote(file *RemoteFile) (*LockInfo, error) {
+	reader, err := l.blobs.GetBlob(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, _, err := openDownload(l.encryptor, reader, blobFormat(file.UploadTimestamp))
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	info := &LockInfo{}
+	if err := json.NewDecoder(content).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// 对锁文件加排他文件锁（flock），不等待；其他进程持有时返回 false
+func lockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 释放锁文件上的文件锁
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// 检查本机上的进程是否存在
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// 进程ID所属的命名空间：Linux 上为启动ID和PID命名空间，同名主机的不同容器或重启后的进程ID不可比较；
+// 没有 /proc 的系统返回空字符串，同名主机上的进程ID视为可比较
+func pidNamespace() string {
+	ns, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		return ""
+	}
+	bootID, _ := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(bootID)) + "/" + ns
+}
@@ -0,0 +1,51 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// GetExitCodeProcess 对仍在运行的进程返回的退出码
+const stillActive = 259
+
+// 锁定锁文件内容之外的一个字节，Windows 的字节范围锁会阻止其他进程读取被锁定的范围
+var lockRange = windows.Overlapped{OffsetHigh: 1}
+
+// 对锁文件加排他锁，不等待；其他进程持有时返回 false
+func lockFile(f *os.File) (bool, error) {
+	overlapped := lockRange
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 释放锁文件上的锁
+func unlockFile(f *os.File) error {
+	overlapped := lockRange
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &overlapped)
+}
+
+// 检查本机上的进程是否存在
+func processExists(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(handle)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// 进程ID所属的命名空间，Windows 上同名主机的进程ID视为可比较
+func pidNamespace() string {
+	return ""
+}
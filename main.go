@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -18,6 +20,24 @@ type Config struct {
 	AccountID                string
 	ApplicationKey           string
 	RetentionDays            int
+	RetentionDailyDays       int // 每天保留一个版本的天数
+	RetentionWeeklyWeeks     int // 每周保留一个版本的周数
+	RetentionMonthlyMonths   int // 每月保留一个版本的月数
+	HiddenFileGraceDays      int // 同步删除隐藏的文件至少保留最后一个版本的天数
+	MaxDeleteCount           int // 单次运行最多删除的文件数，0表示不限制
+	MaxDeletePercent         int // 单次运行最多删除的已备份文件百分比，0表示不限制
+	MaxChangedPercent        int // 单次运行最多修改的已备份文件百分比，0表示不限制
+	EncryptionPassphrase     string // 客户端加密口令
+	EncryptionKeyFile        string // 客户端加密密钥文件（与口令二选一）
+	EncryptFileNames         bool   // 是否加密远程文件名（需要启用客户端加密）
+	Compression              string // 上传压缩算法：none, gzip, zstd
+	CompressionLevel         int    // 压缩级别，0表示算法默认值
+	RepositoryMode           string // 仓库模式：files, chunked
+	ChunkPrefix              string // 分块模式下分块的存储前缀（相对于bucket根目录）
+	PackPrefix               string // 打包模式下包的存储前缀（相对于bucket根目录）
+	PackMaxFileSizeKB        int    // 打包模式下小于该大小的文件打包上传
+	PackTargetSizeMB         int    // 打包模式下每个包的目标大小
+	SnapshotPrefix           string // 快照清单的存储前缀（相对于bucket根目录）
 	SmtpServer               string
 	SmtpPort                 int
 	SmtpUser                 string
@@ -28,9 +48,32 @@ type Config struct {
 	SyncDelete               bool
 	BackupPrefix             string
 	LocalStatePath           string // 本地状态文件路径
+	StateStore               string // 状态存储：json, bolt
+	AutoRebuildState         bool   // 本地状态为空时是否自动从远程备份重建
+	StateGenerations         int    // 保留的历史状态文件代数
+	StateCheckpointSeconds   int    // 上传过程中保存状态的间隔（秒），0表示只在运行结束时保存
+	RemoteLock               bool   // 是否在存储后端中创建远程运行锁（多台主机备份到同一位置时使用）
+	LockPrefix               string // 远程锁对象的存储前缀（相对于bucket根目录）
+	LockStaleMinutes         int    // 运行锁超过该时间未刷新视为过期，0表示只按主机和进程判断
 	EnableEmailNotification  bool   // 是否启用邮件通知
 	EnableMetadataCheck      bool   // 是否启用元数据检查（防止重复上传）
 	MetadataStrategy         string // 元数据策略：none, basic, full
+	StorageBackend           string // 存储后端：b2, s3, local
+	LocalStorageDir          string // 本地存储后端的目标目录
+	S3Endpoint               string // S3兼容端点，如 s3.us-west-004.backblazeb2.com 或 http://localhost:9000
+	S3Region                 string // S3区域
+	S3Bucket                 string // S3 bucket名称
+	S3AccessKey              string // S3访问密钥ID
+	S3SecretKey              string // S3访问密钥
+	S3PathStyle              bool   // 是否使用路径风格访问（MinIO等通常需要）
+	UploadConcurrency        int    // 并发上传的文件数
+	UploadChunkSizeMB        int    // 大文件分片大小（MB），0表示自动
+	UploadPartConcurrency    int    // 每个大文件并发上传的分片数，0表示自动
+	ResumeMaxAgeHours        int    // 未完成的大文件上传超过该时间后放弃续传
+	ScanMode                 string // 扫描模式：fast, full
+	FullScanInterval         int    // 快速模式下每N次运行进行一次完整校验，0表示不进行
+	HashConcurrency          int    // 扫描时并发计算校验和的文件数，0表示CPU核数
+	MaxScanErrors            int    // 允许的无法读取路径数，超过时备份失败，负数表示不限制
 }
 
 // 文件状态信息
@@ -44,8 +87,17 @@ type FileState struct {
 
 // 本地状态结构
 type LocalState struct {
-	LastBackup time.Time             `json:"last_backup"`
-	Files      map[string]*FileState `json:"files"`
+	Version                int                       `json:"version"`                    // 状态结构版本，见 stateVersion
+	LastBackup             time.Time                 `json:"last_backup"`
+	Files                  map[string]*FileState     `json:"files"`
+	PendingUploads         map[string]*PendingUpload `json:"pending_uploads,omitempty"`  // 未完成的大文件上传
+	LastFullScan           time.Time                 `json:"last_full_scan"`             // 上次完整校验的时间
+	FastScansSinceFullScan int                       `json:"fast_scans_since_full_scan"` // 上次完整校验之后的快速扫描次数
+	LastSnapshot           string                    `json:"last_snapshot,omitempty"`    // 最近一次上传的快照ID
+
+	mu      sync.Mutex      // 保护上传过程中对状态的并发修改和保存
+	dirty   map[string]bool // 上次保存之后修改或删除的文件路径
+	tracked bool            // 文件表与状态存储中的内容一致，之后的修改都记录在 dirty 中
 }
 
 // 加载环境变量
@@ -59,6 +111,11 @@ func loadConfig() Config {
 		exclude = []string{}
 	}
 
+	scanMode := os.Getenv("SCAN_MODE")
+	if scanMode == "" {
+		scanMode = ScanModeFast
+	}
+	
 	// 设置默认元数据策略
 	metadataStrategy := os.Getenv("METADATA_STRATEGY")
 	if metadataStrategy == "" {
@@ -71,6 +128,24 @@ func loadConfig() Config {
 		AccountID:                os.Getenv("B2_ACCOUNT_ID"),
 		ApplicationKey:           os.Getenv("B2_APPLICATION_KEY"),
 		RetentionDays:            parseInt(os.Getenv("RETENTION_DAYS"), 30),
+		RetentionDailyDays:       parseInt(os.Getenv("RETENTION_DAILY_DAYS"), 0),
+		RetentionWeeklyWeeks:     parseInt(os.Getenv("RETENTION_WEEKLY_WEEKS"), 0),
+		RetentionMonthlyMonths:   parseInt(os.Getenv("RETENTION_MONTHLY_MONTHS"), 0),
+		HiddenFileGraceDays:      parseInt(os.Getenv("HIDDEN_FILE_GRACE_DAYS"), 30),
+		MaxDeleteCount:           parseInt(os.Getenv("MAX_DELETE_COUNT"), 0),
+		MaxDeletePercent:         parseInt(os.Getenv("MAX_DELETE_PERCENT"), 50),
+		MaxChangedPercent:        parseInt(os.Getenv("MAX_CHANGED_PERCENT"), 50),
+		EncryptionPassphrase:     os.Getenv("ENCRYPTION_PASSPHRASE"),
+		EncryptionKeyFile:        os.Getenv("ENCRYPTION_KEY_FILE"),
+		EncryptFileNames:         os.Getenv("ENCRYPT_FILE_NAMES") == "true",
+		Compression:              os.Getenv("COMPRESSION"),
+		CompressionLevel:         parseInt(os.Getenv("COMPRESSION_LEVEL"), 0),
+		RepositoryMode:           os.Getenv("REPOSITORY_MODE"),
+		ChunkPrefix:              os.Getenv("CHUNK_PREFIX"),
+		PackPrefix:               os.Getenv("PACK_PREFIX"),
+		PackMaxFileSizeKB:        parseInt(os.Getenv("PACK_MAX_FILE_SIZE_KB"), 512),
+		PackTargetSizeMB:         parseInt(os.Getenv("PACK_TARGET_SIZE_MB"), 64),
+		SnapshotPrefix:           os.Getenv("SNAPSHOT_PREFIX"),
 		SmtpServer:               os.Getenv("SMTP_SERVER"),
 		SmtpPort:                 parseInt(os.Getenv("SMTP_PORT"), 587),
 		SmtpUser:                 os.Getenv("SMTP_USER"),
@@ -81,9 +156,32 @@ func loadConfig() Config {
 		SyncDelete:               os.Getenv("SYNC_DELETE") == "true",
 		BackupPrefix:             os.Getenv("BACKUP_PREFIX"),
 		LocalStatePath:           os.Getenv("LOCAL_STATE_PATH"),
+		StateStore:               os.Getenv("STATE_STORE"),
+		AutoRebuildState:         os.Getenv("AUTO_REBUILD_STATE") != "false",
+		StateGenerations:         parseInt(os.Getenv("STATE_GENERATIONS"), 3),
+		StateCheckpointSeconds:   parseInt(os.Getenv("STATE_CHECKPOINT_SECONDS"), 60),
+		RemoteLock:               os.Getenv("REMOTE_LOCK") == "true",
+		LockPrefix:               os.Getenv("LOCK_PREFIX"),
+		LockStaleMinutes:         parseInt(os.Getenv("LOCK_STALE_MINUTES"), 30),
 		EnableEmailNotification:  os.Getenv("ENABLE_EMAIL_NOTIFICATION") == "true",
 		EnableMetadataCheck:      os.Getenv("ENABLE_METADATA_CHECK") == "true",
 		MetadataStrategy:         metadataStrategy,
+		StorageBackend:           os.Getenv("STORAGE_BACKEND"),
+		LocalStorageDir:          os.Getenv("LOCAL_STORAGE_DIR"),
+		S3Endpoint:               os.Getenv("S3_ENDPOINT"),
+		S3Region:                 os.Getenv("S3_REGION"),
+		S3Bucket:                 os.Getenv("S3_BUCKET_NAME"),
+		S3AccessKey:              os.Getenv("S3_ACCESS_KEY_ID"),
+		S3SecretKey:              os.Getenv("S3_SECRET_ACCESS_KEY"),
+		S3PathStyle:              os.Getenv("S3_PATH_STYLE") == "true",
+		UploadConcurrency:        parseInt(os.Getenv("UPLOAD_CONCURRENCY"), 4),
+		UploadChunkSizeMB:        parseInt(os.Getenv("UPLOAD_CHUNK_SIZE_MB"), 0),
+		UploadPartConcurrency:    parseInt(os.Getenv("UPLOAD_PART_CONCURRENCY"), 0),
+		ResumeMaxAgeHours:        parseInt(os.Getenv("RESUME_MAX_AGE_HOURS"), 168),
+		ScanMode:                 scanMode,
+		FullScanInterval:         parseInt(os.Getenv("FULL_SCAN_INTERVAL"), 0),
+		HashConcurrency:          parseInt(os.Getenv("HASH_CONCURRENCY"), 0),
+		MaxScanErrors:            parseInt(os.Getenv("MAX_SCAN_ERRORS"), 100),
 	}
 }
 
@@ -148,98 +246,245 @@ func getMetadataFileName(remotePath string) string {
 	return remotePath + ".meta"
 }
 
-func main() {
-	startTime := time.Now()
-	log.Println("Starting file sync backup...")
-	
-	// 加载配置
-	config := loadConfig()
-	
-	// 验证必要配置
-	if config.SourceDir == "" || config.BucketName == "" || 
-	   config.AccountID == "" || config.ApplicationKey == "" {
-		log.Fatal("Missing required environment variables")
-	}
-	
-	// 设置默认值
+// 设置配置默认值
+func applyConfigDefaults(config *Config) {
 	if config.BackupPrefix == "" {
 		config.BackupPrefix = "backups/"
 	} else if !strings.HasSuffix(config.BackupPrefix, "/") {
 		config.BackupPrefix += "/"
 	}
+
+	// 默认每个备份前缀使用单独的分块前缀：垃圾回收只读取本备份的分块清单，共享的分块前缀中其他备份的分块会被删除
+	if config.ChunkPrefix == "" {
+		config.ChunkPrefix = "chunks/" + config.BackupPrefix
+	} else if !strings.HasSuffix(config.ChunkPrefix, "/") {
+		config.ChunkPrefix += "/"
+	}
+	
+	// 默认每个备份前缀使用单独的包前缀，避免不同备份的索引混在一起
+	if config.PackPrefix == "" {
+		config.PackPrefix = "packs/" + config.BackupPrefix
+	} else if !strings.HasSuffix(config.PackPrefix, "/") {
+		config.PackPrefix += "/"
+	}
+	
+	if config.SnapshotPrefix == "" {
+		config.SnapshotPrefix = "snapshots/" + config.BackupPrefix
+	} else if !strings.HasSuffix(config.SnapshotPrefix, "/") {
+		config.SnapshotPrefix += "/"
+	}
+	
+	if config.LockPrefix == "" {
+		config.LockPrefix = "locks/" + config.BackupPrefix
+	} else if !strings.HasSuffix(config.LockPrefix, "/") {
+		config.LockPrefix += "/"
+	}
 	
 	if config.LocalStatePath == "" {
 		config.LocalStatePath = "/var/backup/state.json"
 	}
 	
+	if config.StorageBackend == "" {
+		config.StorageBackend = StorageBackendB2
+	}
+}
+
+func main() {
+	// 加载配置
+	config := loadConfig()
+	applyConfigDefaults(&config)
+	
+	// 解析子命令，默认执行备份
+	command := "backup"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	
+	switch command {
+	case "backup":
+		runBackup(config, args)
+	case "restore":
+		runRestore(config, args)
+	case "prune":
+		runPrune(config, args)
+	case "snapshot":
+		runSnapshot(config, args)
+	case "state":
+		runState(config, args)
+	default:
+		log.Fatalf("Unknown command: %s (available: backup, restore, prune, snapshot, state)", command)
+	}
+}
+
+// 根据配置创建邮件通知实例
+func newEmailNotifier(config Config) *EmailNotification {
+	return NewEmailNotification(EmailConfig{
+		Server:   config.SmtpServer,
+		Port:     config.SmtpPort,
+		User:     config.SmtpUser,
+		Password: config.SmtpPassword,
+		From:     config.EmailFrom,
+		To:       config.EmailTo,
+		Enabled:  config.EnableEmailNotification,
+	})
+}
+
+// 执行备份流程
+func runBackup(config Config, args []string) {
+	startTime := time.Now()
+	
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	fullScan := flags.Bool("full-scan", false, "hash every file instead of trusting unchanged size and mtime")
+	force := flags.Bool("force", false, "run even if the mass-deletion or mass-change thresholds are exceeded")
+	flags.Parse(args)
+	
+	log.Println("Starting file sync backup...")
+	
+	// 验证必要配置
+	if config.SourceDir == "" {
+		log.Fatal("Missing required environment variables: SOURCE_DIR is required")
+	}
+	if err := validateStorageConfig(config); err != nil {
+		log.Fatalf("Missing required environment variables: %v", err)
+	}
+	
 	log.Printf("Source directory: %s", config.SourceDir)
+	log.Printf("Storage backend: %s", config.StorageBackend)
 	log.Printf("Exclude patterns: %v", config.ExcludePatterns)
 	log.Printf("Sync delete: %v", config.SyncDelete)
 	log.Printf("Local state path: %s", config.LocalStatePath)
+	log.Printf("State store: %s", config.StateStore)
 	log.Printf("Email notification: %v", config.EnableEmailNotification)
 	log.Printf("Enable metadata check: %v", config.EnableMetadataCheck)
 	log.Printf("Metadata strategy: %s", config.MetadataStrategy)
+	log.Printf("Upload concurrency: %d", config.UploadConcurrency)
+	log.Printf("Scan mode: %s", config.ScanMode)
+	
+	// 上一次运行尚未结束时不开始新的运行
+	runLock, err := AcquireRunLock(config, "backup")
+	if err != nil {
+		log.Fatalf("Backup not started: %v", err)
+	}
+	defer runLock.Release()
 	
 	// 创建各个模块实例
 	stateManager := NewStateManager(config)
+	defer stateManager.Close()
 	fileScanner := NewFileScanner(config)
 	
 	// 加载本地状态
 	localState, err := stateManager.LoadState()
 	if err != nil {
-		log.Fatalf("Failed to load local state: %v", err)
+		runLock.Fatalf("Failed to load local state: %v", err)
+	}
+	
+	// 本地状态丢失（如更换主机）时从远程备份重建，避免重新上传全部文件
+	if config.AutoRebuildState && stateIsEmpty(localState) {
+		log.Println("Local state is empty, rebuilding it from the remote backup...")
+		if rebuilt, err := rebuildState(config); err != nil {
+			log.Printf("Warning: Could not rebuild local state, all files will be uploaded: %v", err)
+		} else {
+			localState = rebuilt
+		}
+	}
+	
+	// 快速模式下按间隔或命令行参数进行完整校验
+	if *fullScan || fileScanner.FullHashDue(localState) {
+		fileScanner.SetFullHash(true)
+		log.Println("Full scan: hashing every file")
 	}
 	
 	// 扫描本地文件并检测变化
+	backedUpFiles := countBackedUp(localState)
 	log.Println("Scanning for changed files...")
 	changedFiles, err := fileScanner.ScanAndCompareFiles(localState)
 	if err != nil {
-		log.Fatalf("File scan failed: %v", err)
+		// 无法读取的路径过多时在退出前发送失败通知，列出这些路径
+		message := fmt.Sprintf("Backup of %s failed during the file scan, nothing was uploaded or deleted:\n%v\n", config.SourceDir, err)
+		if scanErrors := fileScanner.ScanErrors(); len(scanErrors) > 0 {
+			message += "\n" + formatScanErrors(scanErrors)
+		}
+		if err := newEmailNotifier(config).SendCustomNotification("Backup Failed: File Scan Error", message); err != nil {
+			log.Printf("Failed to send email notification: %v", err)
+		}
+		runLock.Fatalf("File scan failed: %v", err)
 	}
 	log.Printf("Found %d changed files", len(changedFiles))
 	
-	// 如果没有文件变化，直接退出
-	if len(changedFiles) == 0 {
+	// 无法读取的路径不中断备份，但需要出现在统计和通知中
+	scanErrors := fileScanner.ScanErrors()
+	if len(scanErrors) > 0 {
+		log.Printf("Warning: %d paths could not be read and were not backed up", len(scanErrors))
+	}
+	
+	// 查找需要同步删除的文件
+	var deletedFiles []string
+	if config.SyncDelete {
+		deletedFiles = fileScanner.FindDeletedFiles(localState)
+	}
+	
+	// 在上传和删除之前检查大量删除和大量变化，避免源目录丢失或被加密时破坏备份
+	guard := NewSafetyGuard(config)
+	if err := guard.Check(backedUpFiles, fileScanner.ModifiedCount(), len(deletedFiles)); err != nil {
+		if !*force {
+			message := fmt.Sprintf("Backup of %s was aborted before uploading or deleting anything:\n%v\n\n"+
+				"Check that the source directory is mounted and intact, then rerun with --force if the changes are expected.",
+				config.SourceDir, err)
+			if err := newEmailNotifier(config).SendCustomNotification("Backup Aborted: Safety Threshold Exceeded", message); err != nil {
+				log.Printf("Failed to send email notification: %v", err)
+			}
+			runLock.Fatalf("Safety guard: %v (use --force to override)", err)
+		}
+		log.Printf("Warning: Safety guard overridden with --force: %v", err)
+	}
+	
+	// 如果没有文件变化、删除或扫描错误，且已有描述当前备份的快照，保存扫描结果后退出
+	if len(changedFiles) == 0 && len(deletedFiles) == 0 && len(scanErrors) == 0 && localState.LastSnapshot != "" {
+		if err := stateManager.SaveState(localState); err != nil {
+			log.Printf("Failed to save local state: %v", err)
+		}
 		log.Println("No files changed, backup skipped")
 		return
 	}
 	
-	// 创建B2存储实例
-	b2Storage, err := NewB2Storage(config)
+	// 创建存储后端实例
+	storage, err := NewStorage(config)
 	if err != nil {
-		log.Fatalf("B2 storage initialization failed: %v", err)
+		runLock.Fatalf("Storage initialization failed: %v", err)
 	}
-	defer b2Storage.Close()
+	defer storage.Close()
 	
-	// 获取B2文件列表
-	log.Println("Fetching B2 file list...")
-	b2Files, err := b2Storage.GetFileList()
+	if err := runLock.AcquireRemote(storage); err != nil {
+		runLock.Fatalf("Backup not started: %v", err)
+	}
+	
+	// 获取远程文件列表
+	log.Println("Fetching remote file list...")
+	remoteFiles, err := storage.GetFileList()
 	if err != nil {
-		log.Fatalf("B2 file list retrieval failed: %v", err)
+		runLock.Fatalf("Remote file list retrieval failed: %v", err)
 	}
-	log.Printf("Found %d files in B2", len(b2Files))
+	log.Printf("Found %d files in %s storage", len(remoteFiles), config.StorageBackend)
 	
 	// 统计信息
 	stats := map[string]int{
-		"uploaded": 0,
-		"deleted":  0,
-		"skipped":  0,
-		"failed":   0,
+		"uploaded":    0,
+		"deleted":     0,
+		"skipped":     0,
+		"failed":      0,
+		"scan_errors": len(scanErrors),
 	}
 	
-	// 上传变化的文件
-	for _, fileState := range changedFiles {
-		localPath := filepath.Join(config.SourceDir, fileState.Path)
-		
-		log.Printf("Uploading changed file: %s", fileState.Path)
-		if err := b2Storage.UploadFile(localPath, fileState.Path, fileState.Checksum); err != nil {
-			log.Printf("Upload failed for %s: %v", fileState.Path, err)
-			stats["failed"]++
-		} else {
-			stats["uploaded"]++
-			fileState.BackedUp = true // 标记为已备份
-		}
-	}
+	// 并发上传变化的文件，支持续传的存储后端会记录未完成的大文件上传
+	// 本次运行的快照上传之前，之前的快照不再描述备份内容（检查点保存的状态中也不能保留）
+	localState.LastSnapshot = ""
+	
+	uploader := NewUploader(config, storage, localState)
+	uploader.EnableResume(NewUploadResumer(config, localState, stateManager))
+	uploader.EnableCheckpoints(stateManager)
+	uploader.UploadFiles(changedFiles, stats)
 	
 	// 处理删除（如果启用）
 	if config.SyncDelete {
@@ -255,10 +500,10 @@ func main() {
 					continue
 				}
 				
-				// 检查云端是否有对应文件
-				if remoteFile, exists := b2Files[relPath]; exists {
-					log.Printf("Deleting removed file: %s", relPath)
-					if err := b2Storage.DeleteFile(remoteFile); err != nil {
+				// 检查云端是否有对应文件，只隐藏不删除，之前的版本由保留策略在宽限期后清理
+				if remoteFile, exists := remoteFiles[relPath]; exists {
+					log.Printf("Hiding removed file: %s", relPath)
+					if err := storage.HideFile(remoteFile); err != nil {
 						log.Printf("Delete failed for %s: %v", relPath, err)
 						stats["failed"]++
 					} else {
@@ -270,10 +515,22 @@ func main() {
 		}
 	}
 	
+	// 上传本次运行的快照清单，失败时下次运行重新生成
+	if snapshots, err := NewSnapshotStore(config, storage); err != nil {
+		log.Printf("Snapshot skipped: %v", err)
+	} else if snapshot, err := snapshots.Create(localState); err != nil {
+		log.Printf("Failed to upload snapshot: %v", err)
+		localState.LastSnapshot = ""
+	} else {
+		log.Printf("Snapshot %s uploaded (%d files)", snapshot.ID, len(snapshot.Files))
+		localState.LastSnapshot = snapshot.ID
+	}
+	
 	// 执行保留策略
-	if config.RetentionDays > 0 {
-		log.Println("Applying retention policy...")
-		if err := b2Storage.ManageRetention(); err != nil {
+	if retention := NewRetentionManager(config, storage); retention.Enabled() {
+		retention.SetForce(*force)
+		log.Printf("Applying retention policy: %s", retention.Describe())
+		if err := retention.ManageRetention(); err != nil {
 			log.Printf("Retention policy failed: %v", err)
 		}
 	}
@@ -285,7 +542,7 @@ func main() {
 	if err := stateManager.SaveState(localState); err != nil {
 		log.Printf("Failed to save local state: %v", err)
 	} else {
-		log.Printf("Local state saved to %s", config.LocalStatePath)
+		log.Printf("Local state saved to %s", stateManager.GetStatePath())
 	}
 	
 	// 计算执行时间
@@ -293,30 +550,28 @@ func main() {
 	
 	// 准备统计信息
 	statsMsg := fmt.Sprintf("Backup completed in %v\n", duration.Round(time.Second))
-	statsMsg += fmt.Sprintf("Uploaded: %d, Deleted: %d, Skipped: %d, Failed: %d",
-		stats["uploaded"], stats["deleted"], stats["skipped"], stats["failed"])
+	statsMsg += fmt.Sprintf("Uploaded: %d, Deleted: %d, Skipped: %d, Failed: %d, Unreadable: %d",
+		stats["uploaded"], stats["deleted"], stats["skipped"], stats["failed"], stats["scan_errors"])
 	
 	log.Println(statsMsg)
-	
-	// 创建邮件通知实例并发送通知
-	emailConfig := EmailConfig{
-		Server:   config.SmtpServer,
-		Port:     config.SmtpPort,
-		User:     config.SmtpUser,
-		Password: config.SmtpPassword,
-		From:     config.EmailFrom,
-		To:       config.EmailTo,
-		Enabled:  config.EnableEmailNotification,
+	for _, scanErr := range scanErrors {
+		log.Printf("Unreadable: %s: %v", scanErr.Path, scanErr.Err)
 	}
 	
-	emailNotifier := NewEmailNotification(emailConfig)
+	// 在可能以错误退出之前释放运行锁，避免远程锁对象残留
+	runLock.Release()
+	
+	// 发送邮件通知
+	emailNotifier := newEmailNotifier(config)
 	success := stats["failed"] == 0
-	if err := emailNotifier.SendNotification(success, stats); err != nil {
+	if err := emailNotifier.SendNotification(success, stats, scanErrors); err != nil {
 		log.Printf("Failed to send email notification: %v", err)
 	}
 	
 	if !success {
 		log.Fatal("Backup completed with errors")
+	} else if len(scanErrors) > 0 {
+		log.Printf("Backup completed with %d unreadable paths", len(scanErrors))
 	} else {
 		log.Println("Backup completed successfully")
 	}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// 加密文件名格式：base32(合成IV(16) | AES-256-CTR(补齐的相对路径))，按固定长度切分为多级路径
+//
+// 合成IV是补齐后路径的HMAC，同一路径总是得到同一个名称（上传覆盖、按名称查找都依赖这一点），
+// 解密时重新计算并比较，因此无法解密的名称（如启用前上传的文件）不会被误认为加密名称。
+// 整个相对路径作为一个整体加密，远程列表中看不到目录结构，路径长度也只暴露到补齐长度
+const (
+	nameIVSize       = 16
+	namePadding      = 32  // 路径补齐到的长度倍数
+	nameSegmentChars = 128 // 每级路径的最大长度，保证本地存储后端不超过文件系统的文件名长度限制
+)
+
+// 小写 base32 编码，在不区分大小写的文件系统上也能正确区分
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// NamesEncrypted 检查是否启用了文件名加密
+func (e *Encryptor) NamesEncrypted() bool {
+	return e != nil && e.nameKey != nil
+}
+
+// EncryptName 返回相对路径对应的远程名称，未启用文件名加密时原样返回
+func (e *Encryptor) EncryptName(relPath string) string {
+	if !e.NamesEncrypted() || relPath == "" {
+		return relPath
+	}
+
+	padded := make([]byte, (len(relPath)/namePadding+1)*namePadding)
+	copy(padded, relPath)
+
+	iv := e.nameIV(padded)
+	out := make([]byte, nameIVSize+len(padded))
+	copy(out, iv)
+	e.nameStream(iv).XORKeyStream(out[nameIVSize:], padded)
+
+	encoded := nameEncoding.EncodeToString(out)
+	var segments []string
+	for len(encoded) > nameSegmentChars {
+		segments = append(segments, encoded[:nameSegmentChars])
+		encoded = encoded[nameSegmentChars:]
+	}
+	return strings.Join(append(segments, encoded), "/")
+}
+
+// DecryptName 返回远程名称对应的相对路径
+// 未启用文件名加密或名称不是加密名称时（如启用前上传的文件）原样返回
+func (e *Encryptor) DecryptName(name string) string {
+	if !e.NamesEncrypted() {
+		return name
+	}
+
+	data, err := nameEncoding.DecodeString(strings.ReplaceAll(name, "/", ""))
+	if err != nil || len(data) <= nameIVSize || (len(data)-nameIVSize)%namePadding != 0 {
+		return name
+	}
+
+	iv := data[:nameIVSize]
+	padded := make([]byte, len(data)-nameIVSize)
+	e.nameStream(iv).XORKeyStream(padded, data[nameIVSize:])
+	if !hmac.Equal(iv, e.nameIV(padded)) {
+		return name
+	}
+
+	return string(bytes.TrimRight(padded, "\x00"))
+}
+
+// ListPrefix 返回列出相对路径下的文件时使用的名称前缀
+// 加密后的名称不保留目录结构，只能列出全部文件后按解密的路径过滤
+func (e *Encryptor) ListPrefix(remotePath string) string {
+	if e.NamesEncrypted() {
+		return ""
+	}
+	return remotePath
+}
+
+// 计算补齐后路径的合成IV
+func (e *Encryptor) nameIV(padded []byte) []byte {
+	mac := hmac.New(sha256.New, e.nameMACKey)
+	mac.Write(padded)
+	return mac.Sum(nil)[:nameIVSize]
+}
+
+// 创建文件名加密使用的 AES-CTR 密钥流
+func (e *Encryptor) nameStream(iv []byte) cipher.Stream {
+	block, err := aes.NewCipher(e.nameKey)
+	if err != nil {
+		panic(err) // 密钥长度固定为32字节，不会出错
+	}
+	return cipher.NewCTR(block, iv)
+}
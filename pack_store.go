@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 打包模式的对象后缀
+const (
+	packDataSuffix  = ".pack" // 包对象：多个文件（压缩、加密后）的内容依次拼接
+	packIndexSuffix = ".idx"  // 索引对象：文件路径到包内偏移的映射，上传完成后才写入
+)
+
+const packIndexVersion = 1
+
+// 没有索引的包对象（上传索引之前中断）在该时间后才被清理，避免误删正在上传的包
+const orphanPackGracePeriod = 24 * time.Hour
+
+// PackingStorage 支持将小文件打包上传的存储后端
+type PackingStorage interface {
+	// ShouldPack 检查指定大小的文件是否应打包上传
+	ShouldPack(size int64) bool
+	// PackTargetSize 返回每个包的目标大小
+	PackTargetSize() int64
+	// UploadPack 将多个小文件打包上传为一个包对象，返回成功打包的文件（无法读取的文件被跳过）
+	UploadPack(files []*FileState) ([]*FileState, error)
+}
+
+// GarbageCollector 需要清理未被引用的对象的存储（分块模式、打包模式）
+type GarbageCollector interface {
+	// CollectGarbage 删除未被引用的对象，dryRun 时只列出，返回（将被）删除的对象数
+	CollectGarbage(dryRun bool) (int, error)
+}
+
+// DeletionCommitter 延迟写入删除的存储（打包模式）：DeleteFile 只在内存中标记，CommitDeletions 一次性写入
+type DeletionCommitter interface {
+	// CommitDeletions 写入之前的 DeleteFile 记录的删除
+	CommitDeletions() error
+}
+
+// packIndex 包索引
+type packIndex struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Pack    string       `json:"pack,omitempty"` // 包对象名，只包含隐藏标记的索引为空
+	Entries []*packEntry `json:"entries"`
+
+	indexFile *RemoteFile
+	packFile  *RemoteFile
+}
+
+// packEntry 包中的一个文件版本或隐藏标记
+type packEntry struct {
+	Path    string    `json:"path"`
+	Offset  int64     `json:"offset"`
+	Length  int64     `json:"length"` // 包中存储的（压缩、加密后的）长度
+	Size    int64     `json:"size"`   // 原始文件大小
+	SHA1    string    `json:"sha1,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+	Hidden  bool      `json:"hidden,omitempty"`
+	Expired bool      `json:"expired,omitempty"` // 已被保留策略删除，整个包的条目都过期后删除包
+
+	index *packIndex
+}
+
+// PackedStorage 打包存储，包装普通的存储后端
+// 小于 PACK_MAX_FILE_SIZE_KB 的文件打包为接近 PACK_TARGET_SIZE_MB 的包对象上传，
+// 索引中的每个条目作为对应路径的一个版本出现在列表中，因此同步删除、保留策略和时间点恢复都照常工作；
+// 大文件仍作为普通对象上传
+type PackedStorage struct {
+	Storage
+	blobs      BlobStorage
+	config     Config
+	encryptor  *Encryptor
+	compressor *Compressor
+
+	loadOnce   sync.Once
+	loadErr    error
+	mu         sync.Mutex
+	indexes    []*packIndex
+	orphans    map[string]*RemoteFile // 没有索引的包对象
+	superseded []*RemoteFile          // 被重写后的索引取代的旧索引对象
+	expired    map[*packIndex]bool    // 有条目被标记为过期、尚未重写的索引
+}
+
+// NewPackedStorage 创建新的打包存储实例，storage 必须支持 BlobStorage
+func NewPackedStorage(config Config, storage Storage, encryptor *Encryptor, compressor *Compressor) (*PackedStorage, error) {
+	blobs, ok := storage.(BlobStorage)
+	if !ok {
+		return nil, fmt.Errorf("storage backend %s does not support the packed repository mode", config.StorageBackend)
+	}
+
+	return &PackedStorage{
+		Storage:    storage,
+		blobs:      blobs,
+		config:     config,
+		encryptor:  encryptor,
+		compressor: compressor,
+	}, nil
+}
+
+// ShouldPack 检查指定大小的文件是否应打包上传
+func (p *PackedStorage) ShouldPack(size int64) bool {
+	return size < int64(p.config.PackMaxFileSizeKB)*1024
+}
+
+// PackTargetSize 返回每个包的目标大小
+func (p *PackedStorage) PackTargetSize() int64 {
+	return int64(p.config.PackTargetSizeMB) * 1024 * 1024
+}
+
+// UploadPack 将多个小文件打包上传，先上传包对象再上传索引，索引存在时包才被视为完整
+func (p *PackedStorage) UploadPack(files []*FileState) ([]*FileState, error) {
+	if err := p.loadPacks(); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "b2-go-pack-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	id := newObjectID()
+	index := &packIndex{
+		Version: packIndexVersion,
+		Created: time.Now().UTC(),
+		Pack:    p.config.PackPrefix + id + packDataSuffix,
+	}
+
+	var packed []*FileState
+	var offset int64
+	for _, fileState := range files {
+		data, err := p.entryData(fileState)
+		if err == nil {
+			_, err = tmp.Write(data)
+		}
+		if err != nil {
+			log.Printf("Upload failed for %s: %v", fileState.Path, err)
+			continue
+		}
+
+		index.Entries = append(index.Entries, &packEntry{
+			Path:    fileState.Path,
+			Offset:  offset,
+			Length:  int64(len(data)),
+			Size:    fileState.Size,
+			SHA1:    fileState.Checksum,
+			ModTime: fileState.ModTime,
+			index:   index,
+		})
+		offset += int64(len(data))
+		packed = append(packed, fileState)
+	}
+	if len(packed) == 0 {
+		return nil, nil
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := p.blobs.PutBlob(index.Pack, tmp, offset); err != nil {
+		return nil, err
+	}
+	index.packFile = &RemoteFile{Path: index.Pack, Size: offset, UploadTimestamp: index.Created}
+
+	if err := p.writeIndex(id, index); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Uploaded pack %s: %d files, %d bytes", index.Pack, len(packed), offset)
+	return packed, nil
+}
+
+// HideFile 隐藏文件；打包上传的文件通过只包含隐藏标记的索引隐藏
+func (p *PackedStorage) HideFile(file *RemoteFile) error {
+	if _, ok := file.handle.(*packEntry); !ok {
+		return p.Storage.HideFile(file)
+	}
+
+	index := &packIndex{
+		Version: packIndexVersion,
+		Created: time.Now().UTC(),
+	}
+	index.Entries = []*packEntry{{Path: file.Path, Hidden: true, index: index}}
+	return p.writeIndex(newObjectID(), index)
+}
+
+// DeleteFile 删除文件版本；打包上传的版本只标记为过期，CommitDeletions 时每个索引只重写一次
+func (p *PackedStorage) DeleteFile(file *RemoteFile) error {
+	entry, ok := file.handle.(*packEntry)
+	if !ok {
+		return p.Storage.DeleteFile(file)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !entry.Expired {
+		entry.Expired = true
+		if p.expired == nil {
+			p.expired = make(map[*packIndex]bool)
+		}
+		p.expired[entry.index] = true
+	}
+	return nil
+}
+
+// CommitDeletions 重写有条目过期的索引，包中所有条目都过期时删除索引和包
+// 保留策略一次删除同一个包中的多个条目时索引只上传一次；写入失败的索引留到下次提交
+func (p *PackedStorage) CommitDeletions() error {
+	p.mu.Lock()
+	expired := p.expired
+	p.expired = nil
+	p.mu.Unlock()
+
+	var failed []string
+	for index := range expired {
+		if err := p.commitIndex(index); err != nil {
+			log.Printf("Error persisting expired entries of pack index %s: %v", index.indexFile.Path, err)
+			failed = append(failed, index.indexFile.Path)
+			p.mu.Lock()
+			if p.expired == nil {
+				p.expired = make(map[*packIndex]bool)
+			}
+			p.expired[index] = true
+			p.mu.Unlock()
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to persist deletions in %d pack indexes", len(failed))
+	}
+	return nil
+}
+
+// Close 写入尚未提交的删除后关闭存储后端
+func (p *PackedStorage) Close() error {
+	if err := p.CommitDeletions(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return p.Storage.Close()
+}
+
+// 持久化一个索引中条目的过期状态
+// 所有条目都过期时先删除索引再删除包：包删除失败时成为没有索引的包，由 prune 清理
+func (p *PackedStorage) commitIndex(index *packIndex) error {
+	p.mu.Lock()
+	allExpired := true
+	for _, entry := range index.Entries {
+		if !entry.Expired {
+			allExpired = false
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if !allExpired {
+		return p.rewriteIndex(index)
+	}
+
+	if err := p.blobs.DeleteBlob(index.indexFile); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.indexes {
+		if other == index {
+			p.indexes = append(p.indexes[:i], p.indexes[i+1:]...)
+			break
+		}
+	}
+	if index.packFile != nil {
+		log.Printf("Deleting pack %s: all %d entries expired", index.packFile.Path, len(index.Entries))
+		if err := p.blobs.DeleteBlob(index.packFile); err != nil {
+			log.Printf("Warning: Could not delete pack %s, it will be removed by prune: %v", index.packFile.Path, err)
+			if p.orphans == nil {
+				p.orphans = make(map[string]*RemoteFile)
+			}
+			p.orphans[index.packFile.Path] = index.packFile
+		}
+	}
+	return nil
+}
+
+// GetFileList 获取全部文件（包括打包上传的文件）
+func (p *PackedStorage) GetFileList() (map[string]*RemoteFile, error) {
+	return p.ListFiles("")
+}
+
+// GetFileAttrs 读取单个文件的元数据
+func (p *PackedStorage) GetFileAttrs(remotePath string) (*RemoteFile, error) {
+	files, err := p.ListFiles(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := files[remotePath]
+	if !ok {
+		return nil, fmt.Errorf("file not found: %s", remotePath)
+	}
+	return file, nil
+}
+
+// ListFiles 列出指定相对路径下每个文件当前可见的版本
+// 同一路径可能既有普通对象又有打包的条目，因此由合并后的版本列表得出
+func (p *PackedStorage) ListFiles(remotePath string) (map[string]*RemoteFile, error) {
+	versions, err := p.ListFileVersions(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMap := make(map[string]*RemoteFile)
+	for relPath, fileVersions := range versions {
+		if !fileVersions[0].Hidden {
+			fileMap[relPath] = fileVersions[0]
+		}
+	}
+	return fileMap, nil
+}
+
+// ListFilesAsOf 列出指定时间点时每个文件的有效版本
+func (p *PackedStorage) ListFilesAsOf(remotePath string, asOf time.Time) (map[string]*RemoteFile, error) {
+	versions, err := p.ListFileVersions(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMap := make(map[string]*RemoteFile)
+	for relPath, fileVersions := range versions {
+		if file := versionAsOf(fileVersions, asOf); file != nil {
+			fileMap[relPath] = file
+		}
+	}
+	return fileMap, nil
+}
+
+// ListFileVersions 列出每个文件的所有版本，合并普通对象和包索引中的条目
+func (p *PackedStorage) ListFileVersions(remotePath string) (map[string][]*RemoteFile, error) {
+	versions, err := p.Storage.ListFileVersions(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.loadPacks(); err != nil {
+		return nil, err
+	}
+
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	p.mu.Lock()
+	for _, index := range p.indexes {
+		for _, entry := range index.Entries {
+			if !entry.Expired && matchesRemotePath(entry.Path, remotePath) {
+				versions[entry.Path] = append(versions[entry.Path], entry.remoteFile())
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	// 最新版本是打包的条目时，它就是当前可见的版本
+	sortVersions(versions)
+	for _, fileVersions := range versions {
+		if _, ok := fileVersions[0].handle.(*packEntry); ok && !fileVersions[0].Hidden {
+			fileVersions[0].Latest = true
+		}
+	}
+	return versions, nil
+}
+
+// DownloadFile 下载文件；打包上传的文件只读取包中对应的范围
+func (p *PackedStorage) DownloadFile(file *RemoteFile, localPath string) (string, error) {
+	entry, ok := file.handle.(*packEntry)
+	if !ok {
+		return p.Storage.DownloadFile(file, localPath)
+	}
+
+	var reader io.ReadCloser = io.NopCloser(bytes.NewReader(nil))
+	if entry.Length > 0 {
+		var err error
+		reader, err = p.blobs.GetBlobRange(entry.index.Pack, entry.Offset, entry.Length)
+		if err != nil {
+			return "", err
+		}
+	}
+	defer reader.Close()
+
+	checksum, encrypted, err := writeDownload(p.encryptor, reader, localPath, blobFormat(entry.index.indexFile.UploadTimestamp))
+	file.Encrypted = file.Encrypted || encrypted
+	return checksum, err
+}
+
+// CollectGarbage 删除没有索引的包对象（上传索引之前中断的打包上传或删除包失败），以及重写索引时未能删除的旧索引
+func (p *PackedStorage) CollectGarbage(dryRun bool) (int, error) {
+	if err := p.loadPacks(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	p.mu.Lock()
+	superseded := p.superseded
+	p.superseded = nil
+	p.mu.Unlock()
+	for _, index := range superseded {
+		if dryRun {
+			fmt.Printf("Would delete superseded pack index %s\n", index.Path)
+		} else {
+			log.Printf("Deleting superseded pack index: %s", index.Path)
+			if err := p.blobs.DeleteBlob(index); err != nil {
+				log.Printf("Error deleting pack index %s: %v", index.Path, err)
+				continue
+			}
+		}
+		deleted++
+	}
+
+	cutoff := time.Now().Add(-orphanPackGracePeriod)
+	for name, pack := range p.orphans {
+		if pack.UploadTimestamp.After(cutoff) {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would delete orphaned pack %s (%d bytes)\n", name, pack.Size)
+		} else {
+			log.Printf("Deleting orphaned pack: %s", name)
+			if err := p.blobs.DeleteBlob(pack); err != nil {
+				log.Printf("Error deleting pack %s: %v", name, err)
+				continue
+			}
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// 读取文件并转换为包中存储的内容（先压缩再加密，带有压缩头部，与分块的格式相同）
+func (p *PackedStorage) entryData(fileState *FileState) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(p.config.SourceDir, fileState.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	data = p.compressor.EncodeBytes(data)
+	content, _ := p.encryptor.UploadReader(bytes.NewReader(data), int64(len(data)))
+	return io.ReadAll(content)
+}
+
+// 上传索引对象并加入已加载的索引
+func (p *PackedStorage) writeIndex(id string, index *packIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	file, err := p.putIndex(id, data)
+	if err != nil {
+		return err
+	}
+	index.indexFile = file
+
+	p.mu.Lock()
+	p.indexes = append(p.indexes, index)
+	p.mu.Unlock()
+	return nil
+}
+
+// 以新的名称重新上传索引（记录条目的过期状态），再删除之前的索引对象
+// 删除失败时两个索引引用同一个包，加载时使用较新的一个，旧的由 prune 删除
+func (p *PackedStorage) rewriteIndex(index *packIndex) error {
+	p.mu.Lock()
+	data, err := json.Marshal(index)
+	previous := index.indexFile
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := p.putIndex(newObjectID(), data)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite pack index %s: %v", previous.Path, err)
+	}
+	p.mu.Lock()
+	index.indexFile = file
+	p.mu.Unlock()
+
+	if err := p.blobs.DeleteBlob(previous); err != nil {
+		log.Printf("Warning: Could not delete superseded pack index %s: %v", previous.Path, err)
+		p.mu.Lock()
+		p.superseded = append(p.superseded, previous)
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// 压缩、加密并上传索引内容（索引中包含文件路径，与文件内容一样压缩和加密）
+func (p *PackedStorage) putIndex(id string, data []byte) (*RemoteFile, error) {
+	data = p.compressor.EncodeBytes(data)
+	name := p.config.PackPrefix + id + packIndexSuffix
+	content, size := p.encryptor.UploadReader(bytes.NewReader(data), int64(len(data)))
+	if err := p.blobs.PutBlob(name, content, size); err != nil {
+		return nil, err
+	}
+	return &RemoteFile{Path: name, Size: size, UploadTimestamp: time.Now().UTC()}, nil
+}
+
+// 列出并读取所有包索引，每次运行只读取一次，之后上传的包直接加入
+func (p *PackedStorage) loadPacks() error {
+	p.loadOnce.Do(func() {
+		blobs, err := p.blobs.ListBlobs(p.config.PackPrefix)
+		if err != nil {
+			p.loadErr = fmt.Errorf("failed to list packs: %v", err)
+			return
+		}
+
+		var indexes []*packIndex
+		var superseded []*RemoteFile
+		byPack := make(map[string]*packIndex)
+		for name, file := range blobs {
+			if !strings.HasSuffix(name, packIndexSuffix) {
+				continue
+			}
+
+			index, err := p.readIndex(file)
+			if err != nil {
+				p.loadErr = fmt.Errorf("failed to read pack index %s: %v", name, err)
+				return
+			}
+			if index.Pack == "" {
+				indexes = append(indexes, index)
+				continue
+			}
+
+			// 包已被删除时（所有条目过期后删除包之前没能删除的旧索引）索引不再有效
+			if _, exists := blobs[index.Pack]; !exists {
+				superseded = append(superseded, file)
+				continue
+			}
+
+			// 重写索引时中断可能留下引用同一个包的旧索引，使用名称较新（较晚上传）的一个
+			if other, exists := byPack[index.Pack]; exists {
+				if name < other.indexFile.Path {
+					superseded = append(superseded, file)
+					continue
+				}
+				superseded = append(superseded, other.indexFile)
+			}
+			index.packFile = blobs[index.Pack]
+			byPack[index.Pack] = index
+		}
+		for _, index := range byPack {
+			indexes = append(indexes, index)
+		}
+
+		orphans := make(map[string]*RemoteFile)
+		for name, file := range blobs {
+			if _, referenced := byPack[name]; strings.HasSuffix(name, packDataSuffix) && !referenced {
+				orphans[name] = file
+			}
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.indexes = append(indexes, p.indexes...)
+		p.orphans = orphans
+		p.superseded = append(superseded, p.superseded...)
+		log.Printf("Pack store: %d pack indexes under %s", len(indexes), p.config.PackPrefix)
+	})
+	return p.loadErr
+}
+
+// 下载并解析包索引
+func (p *PackedStorage) readIndex(file *RemoteFile) (*packIndex, error) {
+	reader, err := p.blobs.GetBlob(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, _, err := openDownload(p.encryptor, reader, blobFormat(file.UploadTimestamp))
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	index := &packIndex{}
+	if err := json.NewDecoder(content).Decode(index); err != nil {
+		return nil, err
+	}
+	if index.Version != packIndexVersion {
+		return nil, fmt.Errorf("unsupported pack index version %d", index.Version)
+	}
+
+	index.indexFile = file
+	for _, entry := range index.Entries {
+		entry.index = index
+	}
+	return index, nil
+}
+
+// 将包中的条目转换为通用的远程文件信息
+func (e *packEntry) remoteFile() *RemoteFile {
+	id := e.index.Pack
+	if id == "" {
+		id = e.index.indexFile.Path
+	}
+	return &RemoteFile{
+		Path:            e.Path,
+		ID:              fmt.Sprintf("%s@%d", id, e.Offset),
+		Size:            e.Size,
+		SHA1:            e.SHA1,
+		UploadTimestamp: e.index.Created,
+		LastModified:    e.ModTime,
+		Hidden:          e.Hidden,
+		handle:          e,
+	}
+}
+
+// 生成包和快照的ID：上传时间加随机后缀，按名称排序即按时间排序
+func newObjectID() string {
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 统计打包前缀下的索引和包对象数
+func countPackObjects(t *testing.T, storage *PackedStorage) (indexes, packs int) {
+	t.Helper()
+	blobs, err := storage.blobs.ListBlobs(storage.config.PackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range blobs {
+		switch {
+		case strings.HasSuffix(name, packIndexSuffix):
+			indexes++
+		case strings.HasSuffix(name, packDataSuffix):
+			packs++
+		}
+	}
+	return indexes, packs
+}
+
+// 过期的条目在提交时每个索引只重写一次，全部过期后索引和包都被删除
+func TestPackedStorageCommitDeletions(t *testing.T) {
+	config := newTestConfig(t)
+	config.RepositoryMode = RepositoryModePacked
+	config.PackMaxFileSizeKB = 512
+	config.PackTargetSizeMB = 64
+	for _, relPath := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, config.SourceDir, relPath, relPath)
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed := storage.(*PackedStorage)
+	runTestBackup(t, config, storage, &LocalState{Files: make(map[string]*FileState)})
+
+	files, err := storage.GetFileList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, relPath := range []string{"a.txt", "b.txt"} {
+		if err := storage.DeleteFile(files[relPath]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := packed.CommitDeletions(); err != nil {
+		t.Fatal(err)
+	}
+	if indexes, packs := countPackObjects(t, packed); indexes != 1 || packs != 1 {
+		t.Fatalf("%d indexes and %d packs after expiring two entries, want 1 and 1", indexes, packs)
+	}
+	storage.Close()
+
+	// 重新打开后过期状态仍然有效
+	reopened, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if files, err = reopened.GetFileList(); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["c.txt"] == nil {
+		t.Fatalf("files after reopening = %v, want only c.txt", files)
+	}
+
+	if err := reopened.DeleteFile(files["c.txt"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.(*PackedStorage).CommitDeletions(); err != nil {
+		t.Fatal(err)
+	}
+	if indexes, packs := countPackObjects(t, reopened.(*PackedStorage)); indexes != 0 || packs != 0 {
+		t.Fatalf("%d indexes and %d packs after expiring every entry, want none", indexes, packs)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 目标文件已存在时的覆盖策略
+const (
+	OverwriteSkip      = "skip"      // 跳过已存在的文件
+	OverwriteOverwrite = "overwrite" // 覆盖已存在的文件
+	OverwriteRename    = "rename"    // 以新名称保存恢复的文件
+)
+
+// RestoreOptions 恢复选项
+type RestoreOptions struct {
+	RemotePath string    // BACKUP_PREFIX 下的相对路径或目录前缀，为空表示全部
+	TargetDir  string    // 恢复到的本地目录
+	Overwrite  string    // 覆盖策略：skip, overwrite, rename
+	AsOf       time.Time // 时间点恢复：按该时间点的文件版本重建目录，零值表示恢复最新版本
+	Snapshot   *Snapshot // 快照恢复：恢复快照中记录的文件版本，不依赖本地状态
+}
+
+// Restorer 文件恢复器结构体
+type Restorer struct {
+	config  Config
+	storage Storage
+	state   *LocalState
+}
+
+// NewRestorer 创建新的文件恢复器实例
+func NewRestorer(config Config, storage Storage, state *LocalState) *Restorer {
+	return &Restorer{
+		config:  config,
+		storage: storage,
+		state:   state,
+	}
+}
+
+// Restore 从存储后端下载文件到本地目录
+func (r *Restorer) Restore(opts RestoreOptions) (map[string]int, error) {
+	switch opts.Overwrite {
+	case OverwriteSkip, OverwriteOverwrite, OverwriteRename:
+	default:
+		return nil, fmt.Errorf("invalid overwrite policy %q (expected skip, overwrite or rename)", opts.Overwrite)
+	}
+
+	if opts.TargetDir == "" {
+		return nil, fmt.Errorf("target directory is required")
+	}
+
+	var files map[string]*RemoteFile
+	var missing []string
+	var err error
+	switch {
+	case opts.Snapshot != nil:
+		log.Printf("Restoring file versions recorded in snapshot %s (%s)", opts.Snapshot.ID, opts.Snapshot.Time.Format(time.RFC3339))
+		files, missing, err = r.snapshotFiles(opts)
+	case opts.AsOf.IsZero():
+		files, err = r.storage.ListFiles(opts.RemotePath)
+	default:
+		log.Printf("Reconstructing file versions as of %s", opts.AsOf.Format(time.RFC3339))
+		files, err = r.storage.ListFilesAsOf(opts.RemotePath, opts.AsOf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && len(missing) == 0 {
+		return nil, fmt.Errorf("no files found under %q", r.config.BackupPrefix+opts.RemotePath)
+	}
+
+	// 按路径排序，保证恢复顺序稳定
+	paths := make([]string, 0, len(files))
+	for relPath := range files {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+
+	stats := map[string]int{
+		"restored": 0,
+		"skipped":  0,
+		"failed":   len(missing),
+	}
+
+	for _, relPath := range paths {
+		restored, err := r.restoreFile(relPath, files[relPath], opts)
+		if err != nil {
+			log.Printf("Restore failed for %s: %v", relPath, err)
+			stats["failed"]++
+		} else if restored {
+			stats["restored"]++
+		} else {
+			stats["skipped"]++
+		}
+	}
+
+	return stats, nil
+}
+
+// 找出快照中记录的文件版本，返回找到的版本和已不存在（如被保留策略删除）的路径
+// 后端不支持版本ID时使用快照时间点的有效版本，下载后按快照中的校验和校验
+func (r *Restorer) snapshotFiles(opts RestoreOptions) (map[string]*RemoteFile, []string, error) {
+	versions, err := r.storage.ListFileVersions(opts.RemotePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]*RemoteFile)
+	var missing []string
+	for _, entry := range opts.Snapshot.Files {
+		if !matchesRemotePath(entry.Path, opts.RemotePath) {
+			continue
+		}
+
+		var file *RemoteFile
+		if entry.RemoteID == "" {
+			file = versionAsOf(versions[entry.Path], opts.Snapshot.Time)
+		} else {
+			for _, version := range versions[entry.Path] {
+				if version.ID == entry.RemoteID && !version.Hidden {
+					file = version
+					break
+				}
+			}
+		}
+
+		if file == nil {
+			log.Printf("Restore failed for %s: version recorded in snapshot no longer exists", entry.Path)
+			missing = append(missing, entry.Path)
+			continue
+		}
+		files[entry.Path] = file
+	}
+	return files, missing, nil
+}
+
+// 恢复单个文件，返回是否实际写入了文件
+func (r *Restorer) restoreFile(relPath string, file *RemoteFile, opts RestoreOptions) (bool, error) {
+	targetPath, err := restoreTargetPath(opts.TargetDir, relPath)
+	if err != nil {
+		return false, err
+	}
+
+	// 根据覆盖策略处理已存在的文件
+	if _, err := os.Stat(targetPath); err == nil {
+		switch opts.Overwrite {
+		case OverwriteSkip:
+			log.Printf("File %s already exists, skipping", targetPath)
+			return false, nil
+		case OverwriteRename:
+			targetPath = nextAvailablePath(targetPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return false, err
+	}
+
+	// 先下载到临时文件，校验通过后再移动到目标位置
+	tmpPath := filepath.Join(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".b2restore")
+	checksum, err := r.storage.DownloadFile(file, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+
+	// 加密内容在解密时已经过认证，没有校验和时不需要警告
+	expected, source := r.expectedChecksum(relPath, file, opts)
+	if expected == "" {
+		if !file.Encrypted {
+			log.Printf("Warning: No checksum available for %s, skipping verification", relPath)
+		}
+	} else if checksum != expected {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("checksum mismatch (%s): got %s, want %s", source, checksum, expected)
+	}
+
+	if err := os.Rename(tmpPath, targetPath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+
+	// 恢复修改时间
+	if modTime := r.modTime(relPath, file, opts); !modTime.IsZero() {
+		if err := os.Chtimes(targetPath, time.Now(), modTime); err != nil {
+			log.Printf("Warning: Could not restore modification time for %s: %v", targetPath, err)
+		}
+	}
+
+	log.Printf("Restored %s -> %s", relPath, targetPath)
+	return true, nil
+}
+
+// 获取用于校验的SHA1：快照恢复时使用快照中记录的校验和，否则优先使用本地状态中已备份的校验和，
+// 其次使用存储后端记录的内容SHA1；时间点恢复时本地状态描述的是当前版本，因此只使用存储后端记录的SHA1
+func (r *Restorer) expectedChecksum(relPath string, file *RemoteFile, opts RestoreOptions) (string, string) {
+	if opts.Snapshot != nil {
+		if entry := opts.Snapshot.File(relPath); entry != nil && entry.Checksum != "" {
+			return entry.Checksum, "snapshot"
+		}
+	} else if opts.AsOf.IsZero() {
+		if fileState, exists := r.state.Files[relPath]; exists && fileState.BackedUp && fileState.Checksum != "" {
+			return fileState.Checksum, "local state"
+		}
+	}
+
+	if file.SHA1 != "" {
+		return file.SHA1, "remote content SHA1"
+	}
+
+	return "", ""
+}
+
+// 获取恢复文件应设置的修改时间
+func (r *Restorer) modTime(relPath string, file *RemoteFile, opts RestoreOptions) time.Time {
+	if opts.Snapshot != nil {
+		if entry := opts.Snapshot.File(relPath); entry != nil {
+			return entry.ModTime
+		}
+	} else if opts.AsOf.IsZero() {
+		if fileState, exists := r.state.Files[relPath]; exists {
+			return fileState.ModTime
+		}
+	}
+
+	return file.LastModified
+}
+
+// 计算恢复目标路径，拒绝逃逸出目标目录的路径
+func restoreTargetPath(targetDir, relPath string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(relPath))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to restore path outside target directory: %s", relPath)
+	}
+	return filepath.Join(targetDir, cleaned), nil
+}
+
+// 为已存在的文件生成不冲突的新名称，如 report.restored-1.txt
+func nextAvailablePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.restored-%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// 解析时间点参数，未带时区的时间按本地时区处理
+func parseAsOf(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	layouts := []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// 执行恢复命令
+func runRestore(config Config, args []string) {
+	startTime := time.Now()
+
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	remotePath := flags.String("path", "", "remote path or prefix under BACKUP_PREFIX to restore (default: everything)")
+	targetDir := flags.String("target", "", "local directory to restore into")
+	overwrite := flags.String("overwrite", OverwriteSkip, "policy for existing files: skip, overwrite or rename")
+	asOfValue := flags.String("as-of", "", "restore the tree as it was at this time, e.g. 2026-09-30T12:00 (local time) or RFC3339")
+	snapshotID := flags.String("snapshot", "", "restore the file versions recorded in this snapshot (ID, unique ID prefix or \"latest\")")
+	flags.Parse(args)
+
+	if *asOfValue != "" && *snapshotID != "" {
+		log.Fatal("-as-of and -snapshot are mutually exclusive")
+	}
+
+	var asOf time.Time
+	if *asOfValue != "" {
+		var err error
+		asOf, err = parseAsOf(*asOfValue)
+		if err != nil {
+			log.Fatalf("Invalid -as-of value: %v", err)
+		}
+	}
+
+	// 验证必要配置
+	if err := validateStorageConfig(config); err != nil {
+		log.Fatalf("Missing required environment variables: %v", err)
+	}
+	if *targetDir == "" {
+		log.Fatal("Missing required flag: -target")
+	}
+
+	log.Printf("Restoring %q from %s storage to %s (overwrite: %s)",
+		config.BackupPrefix+*remotePath, config.StorageBackend, *targetDir, *overwrite)
+
+	// 加载本地状态，用于校验下载内容
+	localState, err := loadStateLocked(config, "restore")
+	if err != nil {
+		log.Fatalf("Failed to load local state: %v", err)
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		log.Fatalf("Storage initialization failed: %v", err)
+	}
+	defer storage.Close()
+
+	var snapshot *Snapshot
+	if *snapshotID != "" {
+		store, err := NewSnapshotStore(config, storage)
+		if err != nil {
+			log.Fatalf("Snapshot store initialization failed: %v", err)
+		}
+		if snapshot, err = store.Load(*snapshotID); err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+	}
+
+	restorer := NewRestorer(config, storage, localState)
+	stats, err := restorer.Restore(RestoreOptions{
+		RemotePath: *remotePath,
+		TargetDir:  *targetDir,
+		Overwrite:  *overwrite,
+		AsOf:       asOf,
+		Snapshot:   snapshot,
+	})
+	if err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+
+	log.Printf("Restore completed in %v\nRestored: %d, Skipped: %d, Failed: %d",
+		time.Since(startTime).Round(time.Second), stats["restored"], stats["skipped"], stats["failed"])
+
+	if stats["failed"] > 0 {
+		log.Fatal("Restore completed with errors")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// PendingUpload 未完成的大文件上传记录，用于下次运行时续传
+// 续传按远程文件名进行，已上传的分片由存储后端按SHA1与本地内容比对，不一致时上传失败并在下次重新开始
+type PendingUpload struct {
+	Path      string    `json:"path"`
+	Checksum  string    `json:"checksum"`             // 开始上传时文件内容的SHA1
+	Size      int64     `json:"size"`                 // 开始上传时的文件大小
+	ModTime   time.Time `json:"mod_time"`             // 开始上传时文件的修改时间
+	ChunkSize int       `json:"chunk_size"`           // 分片大小，续传时必须一致
+	FileID    string    `json:"file_id,omitempty"`    // 远程未完成上传的ID，上传失败时记录，续传和取消时只使用该上传
+	FileNonce []byte    `json:"file_nonce,omitempty"` // 加密使用的文件随机数，续传时重新加密得到相同的分片
+	StartedAt time.Time `json:"started_at"`
+}
+
+// ResumableStorage 支持跨运行续传大文件的存储后端
+type ResumableStorage interface {
+	// SetUploadResumer 设置续传记录管理器
+	SetUploadResumer(resumer *UploadResumer)
+	// CancelUnfinishedUpload 取消远程未完成的大文件上传，fileID为空时按路径查找
+	CancelUnfinishedUpload(remotePath, fileID string) error
+}
+
+// UploadResumer 续传记录管理器，将未完成的大文件上传记录在本地状态中
+type UploadResumer struct {
+	config       Config
+	state        *LocalState
+	stateManager *StateManager
+}
+
+// NewUploadResumer 创建新的续传记录管理器实例
+func NewUploadResumer(config Config, state *LocalState, stateManager *StateManager) *UploadResumer {
+	if state.PendingUploads == nil {
+		state.PendingUploads = make(map[string]*PendingUpload)
+	}
+
+	return &UploadResumer{
+		config:       config,
+		state:        state,
+		stateManager: stateManager,
+	}
+}
+
+// Begin 开始上传大文件前调用
+// 如果存在本地文件的内容、大小、修改时间和分片大小都一致且未过期的记录，返回该记录用于续传；
+// 如果存在无法续传的旧记录，返回该记录（obsolete），调用方应取消对应的远程上传
+func (r *UploadResumer) Begin(path, checksum string, size int64, modTime time.Time, chunkSize int, fileNonce []byte) (resumed, obsolete *PendingUpload) {
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+
+	if pending, exists := r.state.PendingUploads[path]; exists {
+		if pending.Checksum == checksum && pending.Size == size && pending.ModTime.Equal(modTime) &&
+			pending.ChunkSize == chunkSize && !r.isStale(pending) {
+			log.Printf("Resuming upload of %s started at %s", path, pending.StartedAt.Format(time.RFC3339))
+			return pending, nil
+		}
+		log.Printf("Previous unfinished upload of %s cannot be resumed, starting over", path)
+		obsolete = pending
+	}
+
+	r.state.PendingUploads[path] = &PendingUpload{
+		Path:      path,
+		Checksum:  checksum,
+		Size:      size,
+		ModTime:   modTime,
+		ChunkSize: chunkSize,
+		FileNonce: fileNonce,
+		StartedAt: time.Now(),
+	}
+	r.persist()
+
+	return nil, obsolete
+}
+
+// Fail 上传失败时记录远程未完成上传的ID，以便下次续传
+func (r *UploadResumer) Fail(path, fileID string) {
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+
+	pending, exists := r.state.PendingUploads[path]
+	if !exists {
+		return
+	}
+	if fileID != "" {
+		pending.FileID = fileID
+	}
+	r.persist()
+}
+
+// Finish 上传成功后删除续传记录
+func (r *UploadResumer) Finish(path string) {
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+
+	delete(r.state.PendingUploads, path)
+}
+
+// TakeStale 取出并删除超过最长续传时间的记录，调用方应取消对应的远程上传
+func (r *UploadResumer) TakeStale() []*PendingUpload {
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+
+	var stale []*PendingUpload
+	for path, pending := range r.state.PendingUploads {
+		if r.isStale(pending) {
+			stale = append(stale, pending)
+			delete(r.state.PendingUploads, path)
+		}
+	}
+	if len(stale) > 0 {
+		r.persist()
+	}
+	return stale
+}
+
+// 检查记录是否超过最长续传时间
+func (r *UploadResumer) isStale(pending *PendingUpload) bool {
+	maxAge := time.Duration(r.config.ResumeMaxAgeHours) * time.Hour
+	return maxAge > 0 && time.Since(pending.StartedAt) > maxAge
+}
+
+// 立即保存状态，保证进程中断后续传记录不会丢失（调用方需持有 state.mu）
+func (r *UploadResumer) persist() {
+	if err := r.stateManager.writeState(r.state); err != nil {
+		log.Printf("Warning: Could not save resume record: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionDecision 保留策略决定删除的文件版本及原因
+type RetentionDecision struct {
+	File    *RemoteFile
+	Reason  string
+	current bool // 是否为本地已删除文件的当前数据版本
+}
+
+// RetentionManager 保留策略管理器，按文件版本清理过期的备份
+// 规则按祖父-父-子（GFS）方式组合：
+// RETENTION_DAYS 内的所有版本都保留；之后每天、每周、每月开始时有效的版本分别保留
+// RETENTION_DAILY_DAYS 天、RETENTION_WEEKLY_WEEKS 周、RETENTION_MONTHLY_MONTHS 个月；
+// 同步删除隐藏的文件在 HIDDEN_FILE_GRACE_DAYS 内保留最后一个版本
+type RetentionManager struct {
+	config  Config
+	storage Storage
+	force   bool // 超过大量删除阈值时仍然删除
+}
+
+// NewRetentionManager 创建新的保留策略管理器实例
+func NewRetentionManager(config Config, storage Storage) *RetentionManager {
+	return &RetentionManager{
+		config:  config,
+		storage: storage,
+	}
+}
+
+// SetForce 设置超过大量删除阈值（MAX_DELETE_COUNT、MAX_DELETE_PERCENT）时是否仍然删除
+func (r *RetentionManager) SetForce(force bool) {
+	r.force = force
+}
+
+// Enabled 检查是否配置了任何保留规则
+func (r *RetentionManager) Enabled() bool {
+	return r.config.RetentionDays > 0 || r.config.RetentionDailyDays > 0 ||
+		r.config.RetentionWeeklyWeeks > 0 || r.config.RetentionMonthlyMonths > 0
+}
+
+// Describe 返回保留规则的说明
+func (r *RetentionManager) Describe() string {
+	rules := []string{fmt.Sprintf("all versions for %d days", r.config.RetentionDays)}
+	if r.config.RetentionDailyDays > 0 {
+		rules = append(rules, fmt.Sprintf("one per day for %d days", r.config.RetentionDailyDays))
+	}
+	if r.config.RetentionWeeklyWeeks > 0 {
+		rules = append(rules, fmt.Sprintf("one per week for %d weeks", r.config.RetentionWeeklyWeeks))
+	}
+	if r.config.RetentionMonthlyMonths > 0 {
+		rules = append(rules, fmt.Sprintf("one per month for %d months", r.config.RetentionMonthlyMonths))
+	}
+	return fmt.Sprintf("keep %s; always keep the current version of files that exist locally and the last version of hidden files for %d days",
+		strings.Join(rules, ", "), r.config.HiddenFileGraceDays)
+}
+
+// ManageRetention 删除不再被任何保留规则覆盖的文件版本
+// 删除的本地已删除文件的当前版本超过大量删除阈值时不删除任何版本，返回错误
+func (r *RetentionManager) ManageRetention() error {
+	decisions, current, err := r.plan()
+	if err != nil {
+		return err
+	}
+	if err := r.CheckSafety(decisions, current); err != nil {
+		if !r.force {
+			return fmt.Errorf("safety guard: %v (use --force to override)", err)
+		}
+		log.Printf("Warning: Safety guard overridden with --force: %v", err)
+	}
+
+	for _, decision := range decisions {
+		file := decision.File
+		log.Printf("Deleting old backup: %s (uploaded: %s): %s", file.Path, file.UploadTimestamp, decision.Reason)
+		if err := r.storage.DeleteFile(file); err != nil {
+			log.Printf("Error deleting file %s: %v", file.Path, err)
+		}
+	}
+
+	// 打包模式下的删除只在内存中标记，每个索引在最后重写一次
+	if committer, ok := r.storage.(DeletionCommitter); ok {
+		if err := committer.CommitDeletions(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRetention 计算需要删除的文件版本，不做任何修改，结果按路径和上传时间排序
+func (r *RetentionManager) PlanRetention() ([]RetentionDecision, error) {
+	decisions, _, err := r.plan()
+	return decisions, err
+}
+
+// CheckSafety 按大量删除阈值检查计划删除的当前版本数，current 为有当前数据版本的文件数
+// 源目录被清空或挂载点为空时所有文件都像是在本地被删除，当前版本会在保留期限后全部被删除
+func (r *RetentionManager) CheckSafety(decisions []RetentionDecision, current int) error {
+	deleted := 0
+	for _, decision := range decisions {
+		if decision.current {
+			deleted++
+		}
+	}
+	return NewSafetyGuard(r.config).Check(current, 0, deleted)
+}
+
+// 计算需要删除的文件版本，同时返回有当前数据版本（未被隐藏）的文件数
+func (r *RetentionManager) plan() ([]RetentionDecision, int, error) {
+	// 源目录不可用时（如未挂载）所有文件都会被当作已删除，不能继续
+	if _, err := os.Stat(r.config.SourceDir); err != nil {
+		return nil, 0, fmt.Errorf("source directory unavailable, skipping retention: %v", err)
+	}
+
+	versions, err := r.storage.ListFileVersions("")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	checkpoints := r.checkpoints(now)
+
+	var decisions []RetentionDecision
+	current := 0
+	for relPath, fileVersions := range versions {
+		if !fileVersions[0].Hidden {
+			current++
+		}
+		decisions = append(decisions, r.expiredVersions(relPath, fileVersions, now, checkpoints)...)
+	}
+
+	sort.Slice(decisions, func(i, j int) bool {
+		a, b := decisions[i].File, decisions[j].File
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.UploadTimestamp.Before(b.UploadTimestamp)
+	})
+	return decisions, current, nil
+}
+
+// 找出单个文件中不再被保留规则覆盖的版本，versions 按上传时间从新到旧排序
+// 版本的失效时间是它被更新的版本（或隐藏标记）替换的时间，RETENTION_DAYS 内失效的版本都保留；
+// 本地已删除文件的最新版本没有被替换，按上传时间计算
+func (r *RetentionManager) expiredVersions(relPath string, versions []*RemoteFile, now time.Time, checkpoints []time.Time) []RetentionDecision {
+	keep := make(map[*RemoteFile]bool)
+
+	// 本地仍存在的文件保留最新的数据版本
+	if r.existsLocally(relPath) {
+		for _, file := range versions {
+			if !file.Hidden {
+				keep[file] = true
+				break
+			}
+		}
+	}
+
+	// 宽限期内隐藏的文件保留最后的数据版本，以便恢复误删的文件
+	graceCutoff := now.AddDate(0, 0, -r.config.HiddenFileGraceDays)
+	if versions[0].Hidden && versions[0].UploadTimestamp.After(graceCutoff) {
+		for _, file := range versions[1:] {
+			if !file.Hidden {
+				keep[file] = true
+				break
+			}
+		}
+	}
+
+	// 保留期限内失效的版本
+	cutoff := now.AddDate(0, 0, -r.config.RetentionDays)
+	for i, file := range versions {
+		if !supersededAt(versions, i).Before(cutoff) {
+			keep[file] = true
+		}
+	}
+
+	// 每天、每周、每月开始时有效的版本
+	for _, checkpoint := range checkpoints {
+		for _, file := range versions {
+			if !file.UploadTimestamp.After(checkpoint) {
+				keep[file] = true
+				break
+			}
+		}
+	}
+
+	// 隐藏标记只在之后还保留了更早的数据版本时才有意义；
+	// 最新的隐藏标记在保留了数据版本时必须保留，否则已删除的文件会重新变为可见
+	for i, file := range versions {
+		if !file.Hidden {
+			continue
+		}
+		olderKept := false
+		for _, older := range versions[i+1:] {
+			if !older.Hidden && keep[older] {
+				olderKept = true
+				break
+			}
+		}
+		keep[file] = olderKept && (keep[file] || i == 0)
+	}
+
+	var decisions []RetentionDecision
+	for i, file := range versions {
+		if keep[file] {
+			continue
+		}
+
+		var reason string
+		switch {
+		case file.Hidden:
+			reason = "hide marker with no older versions kept"
+		case versions[0].Hidden && !versions[0].UploadTimestamp.After(graceCutoff) && isLastDataVersion(versions, i):
+			reason = fmt.Sprintf("hidden %s, grace period of %d days expired", versions[0].UploadTimestamp.Format("2006-01-02"), r.config.HiddenFileGraceDays)
+		case i == 0:
+			reason = fmt.Sprintf("file no longer exists locally, last uploaded %s", file.UploadTimestamp.Format("2006-01-02"))
+		default:
+			reason = fmt.Sprintf("superseded %s, not kept by any retention rule", supersededAt(versions, i).Format("2006-01-02"))
+		}
+		decisions = append(decisions, RetentionDecision{File: file, Reason: reason, current: i == 0 && !file.Hidden})
+	}
+
+	return decisions
+}
+
+// 检查版本是否为隐藏标记之前最后的数据版本
+func isLastDataVersion(versions []*RemoteFile, i int) bool {
+	for _, file := range versions[:i] {
+		if !file.Hidden {
+			return false
+		}
+	}
+	return true
+}
+
+// 版本被更新的版本替换的时间，最新版本返回自身的上传时间
+func supersededAt(versions []*RemoteFile, i int) time.Time {
+	if i > 0 {
+		return versions[i-1].UploadTimestamp
+	}
+	return versions[i].UploadTimestamp
+}
+
+// GFS 检查点：最近每天、每周（周一）、每月开始的时刻，检查点时有效的版本会被保留
+func (r *RetentionManager) checkpoints(now time.Time) []time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	weekStart := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	var points []time.Time
+	for i := 0; i < r.config.RetentionDailyDays; i++ {
+		points = append(points, today.AddDate(0, 0, -i))
+	}
+	for i := 0; i < r.config.RetentionWeeklyWeeks; i++ {
+		points = append(points, weekStart.AddDate(0, 0, -7*i))
+	}
+	for i := 0; i < r.config.RetentionMonthlyMonths; i++ {
+		points = append(points, monthStart.AddDate(0, -i, 0))
+	}
+	return points
+}
+
+// 检查文件在源目录中是否仍然存在，无法确定时按存在处理
+func (r *RetentionManager) existsLocally(relPath string) bool {
+	_, err := os.Lstat(filepath.Join(r.config.SourceDir, filepath.FromSlash(relPath)))
+	return !os.IsNotExist(err)
+}
+
+// 执行清理流程，-dry-run 时只列出将被删除的版本和原因
+func runPrune(config Config, args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what would be deleted and why without deleting anything")
+	force := flags.Bool("force", false, "delete even if the mass-deletion thresholds are exceeded")
+	flags.Parse(args)
+
+	// 验证必要配置
+	if config.SourceDir == "" {
+		log.Fatal("Missing required environment variables: SOURCE_DIR is required")
+	}
+	if err := validateStorageConfig(config); err != nil {
+		log.Fatalf("Missing required environment variables: %v", err)
+	}
+
+	// 清理会删除版本和对象，不能与备份同时进行
+	var runLock *RunLock
+	if !*dryRun {
+		var err error
+		if runLock, err = AcquireRunLock(config, "prune"); err != nil {
+			log.Fatalf("Prune not started: %v", err)
+		}
+		defer runLock.Release()
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		runLock.Fatalf("Storage initialization failed: %v", err)
+	}
+	defer storage.Close()
+
+	if runLock != nil {
+		if err := runLock.AcquireRemote(storage); err != nil {
+			runLock.Fatalf("Prune not started: %v", err)
+		}
+	}
+
+	manager := NewRetentionManager(config, storage)
+	if !manager.Enabled() {
+		runLock.Fatalf("No retention rules configured (RETENTION_DAYS, RETENTION_DAILY_DAYS, RETENTION_WEEKLY_WEEKS, RETENTION_MONTHLY_MONTHS)")
+	}
+	manager.SetForce(*force)
+	log.Printf("Retention policy: %s", manager.Describe())
+
+	if !*dryRun {
+		if err := manager.ManageRetention(); err != nil {
+			runLock.Fatalf("Retention policy failed: %v", err)
+		}
+	} else {
+		decisions, current, err := manager.plan()
+		if err != nil {
+			runLock.Fatalf("Retention policy failed: %v", err)
+		}
+		if err := manager.CheckSafety(decisions, current); err != nil {
+			log.Printf("Warning: Safety guard would abort this prune: %v", err)
+		}
+		for _, decision := range decisions {
+			fmt.Printf("Would delete %s (uploaded %s): %s\n",
+				decision.File.Path, decision.File.UploadTimestamp.Format(time.RFC3339), decision.Reason)
+		}
+		log.Printf("Dry run: %d versions would be deleted", len(decisions))
+	}
+
+	// 分块和打包模式下清理不再被引用的分块和包
+	if collector, ok := storage.(GarbageCollector); ok {
+		log.Println("Collecting unreferenced objects...")
+		count, err := collector.CollectGarbage(*dryRun)
+		if err != nil {
+			runLock.Fatalf("Garbage collection failed: %v", err)
+		}
+		if *dryRun {
+			log.Printf("Dry run: %d unreferenced objects would be deleted", count)
+		} else {
+			log.Printf("Deleted %d unreferenced objects", count)
+		}
+	}
+}
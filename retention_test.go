@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 源目录被清空时保留策略不删除当前版本
+func TestRetentionSafetyGuard(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxDeletePercent = 50
+	for _, relPath := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, config.SourceDir, relPath, relPath)
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	runTestBackup(t, config, storage, &LocalState{Files: make(map[string]*FileState)})
+
+	// 模拟空的挂载点
+	entries, err := os.ReadDir(config.SourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(config.SourceDir, entry.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager := NewRetentionManager(config, storage)
+	if err := manager.ManageRetention(); err == nil {
+		t.Fatal("retention deleted every current version without tripping the safety guard")
+	}
+	files, err := storage.GetFileList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("remote has %d files after the aborted retention, want 3", len(files))
+	}
+
+	// --force 时按保留策略删除
+	manager.SetForce(true)
+	if err := manager.ManageRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = storage.GetFileList(); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("remote has %d files after the forced retention, want 0", len(files))
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// 对象元数据中记录内容SHA1的键（S3的ETag不是SHA1），启用加密时记录的是带密钥的摘要
+const s3ChecksumMetaKey = "Sha1"
+
+// 用户元数据在请求头中的前缀，列表结果中的元数据键可能带有该前缀
+const s3UserMetaPrefix = "X-Amz-Meta-"
+
+// S3Storage S3兼容存储结构体（Backblaze S3兼容接口、MinIO等）
+type S3Storage struct {
+	client     *minio.Client
+	bucket     string
+	config     Config
+	encryptor  *Encryptor  // 客户端加密，为空表示不加密
+	compressor *Compressor // 上传前压缩，为空表示不压缩
+}
+
+var (
+	_ Storage        = (*S3Storage)(nil)
+	_ OptionUploader = (*S3Storage)(nil)
+)
+
+// NewS3Storage 创建新的S3兼容存储实例，encryptor 为空时不加密，compressor 为空时不压缩
+func NewS3Storage(config Config, encryptor *Encryptor, compressor *Compressor) (*S3Storage, error) {
+	// 端点可以带 http:// 或 https:// 前缀，默认使用HTTPS
+	endpoint := config.S3Endpoint
+	secure := true
+	if strings.HasPrefix(endpoint, "http://") {
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+		secure = false
+	} else {
+		endpoint = strings.TrimPrefix(endpoint, "https://")
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	lookup := minio.BucketLookupAuto
+	if config.S3PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, ""),
+		Secure:       secure,
+		Region:       config.S3Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查bucket是否存在
+	exists, err := client.BucketExists(context.Background(), config.S3Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", config.S3Bucket)
+	}
+
+	return &S3Storage{
+		client:     client,
+		bucket:     config.S3Bucket,
+		config:     config,
+		encryptor:  encryptor,
+		compressor: compressor,
+	}, nil
+}
+
+// UploadFile 上传文件到S3
+func (s *S3Storage) UploadFile(localPath, remotePath, checksum string) error {
+	return s.UploadFileWithOptions(localPath, remotePath, checksum, UploadOptions{})
+}
+
+// UploadFileWithOptions 按选项上传文件，Force 时不检查远程是否已存在相同文件
+func (s *S3Storage) UploadFileWithOptions(localPath, remotePath, checksum string, opts UploadOptions) error {
+	ctx := context.Background()
+
+	// 检查远程是否已存在相同文件
+	if info, err := s.client.StatObject(ctx, s.bucket, s.objectKey(remotePath), minio.StatObjectOptions{}); err == nil && !opts.Force {
+		log.Printf("File %s already exists in S3, checking if update is needed", remotePath)
+
+		shouldSkip := false
+
+		switch s.config.MetadataStrategy {
+		case "full":
+			// 校验和记录在对象元数据中，不需要额外的元数据文件
+			if s.config.EnableMetadataCheck && s3Metadata(info, s3ChecksumMetaKey) == s.encryptor.ChecksumTag(checksum) {
+				log.Printf("File %s has same checksum (full check), skipping upload", remotePath)
+				shouldSkip = true
+			}
+		case "none":
+			log.Printf("File %s will be uploaded (no duplicate check)", remotePath)
+		default:
+			// 压缩对象的大小与原文件无关，不能按大小判断
+			if localInfo, err := os.Stat(localPath); err == nil && s3Metadata(info, compressionInfoKey) == "" && s.encryptor.UploadSize(localInfo.Size()) == info.Size {
+				log.Printf("File %s has same size (basic check), skipping upload", remotePath)
+				shouldSkip = true
+			}
+		}
+
+		if shouldSkip {
+			return nil
+		}
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 启用加密时上传加密后的内容，并在元数据中记录加密参数
+	// 先压缩再加密，并在元数据中记录压缩算法和加密参数
+	compressed, err := s.compressor.Compress(file, remotePath, fileInfo.Size())
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+
+	content, size := s.encryptor.UploadReader(compressed, compressed.Size)
+	putOpts := minio.PutObjectOptions{
+		ContentType:  "application/octet-stream",
+		UserMetadata: map[string]string{s3ChecksumMetaKey: s.encryptor.ChecksumTag(checksum)},
+	}
+	for key, value := range opts.Info {
+		putOpts.UserMetadata[key] = value
+	}
+	if params := s.encryptor.Params(); params != "" {
+		putOpts.UserMetadata[encryptionInfoKey] = params
+	}
+	if compressed.Algorithm != "" {
+		putOpts.UserMetadata[compressionInfoKey] = compressed.Algorithm
+	}
+
+	// 超过分片大小的文件使用分片上传
+	chunkSize, concurrency := uploadPartSettings(s.config, size)
+	putOpts.PartSize = uint64(chunkSize)
+	putOpts.NumThreads = uint(concurrency)
+	if size > int64(chunkSize) {
+		parts := uploadPartCount(size, chunkSize)
+		log.Printf("Uploading %s as multipart upload: %d parts of %d MB, %d concurrent",
+			remotePath, parts, chunkSize/1000/1000, concurrency)
+		putOpts.Progress = &s3PartProgress{name: remotePath, chunkSize: int64(chunkSize), parts: parts}
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, s.objectKey(remotePath), content, size, putOpts)
+	return err
+}
+
+// s3PartProgress 作为minio的进度读取器，每完成一个分片的数据量输出一次日志
+// 并发分片上传时会被多个协程调用
+type s3PartProgress struct {
+	name      string
+	chunkSize int64
+	parts     int
+	uploaded  int64
+}
+
+func (p *s3PartProgress) Read(b []byte) (int, error) {
+	uploaded := atomic.AddInt64(&p.uploaded, int64(len(b)))
+	before := (uploaded - int64(len(b))) / p.chunkSize
+	if after := uploaded / p.chunkSize; after > before && int(after) < p.parts {
+		log.Printf("Upload progress for %s: %d/%d parts complete", p.name, after, p.parts)
+	}
+	return len(b), nil
+}
+
+// DeleteFile 删除S3对象（指定版本时删除该版本）
+func (s *S3Storage) DeleteFile(file *RemoteFile) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.fileKey(file), minio.RemoveObjectOptions{
+		VersionID: file.ID,
+	})
+}
+
+// HideFile 为S3对象添加删除标记（bucket未开启版本控制时对象会被永久删除）
+func (s *S3Storage) HideFile(file *RemoteFile) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.fileKey(file), minio.RemoveObjectOptions{})
+}
+
+// GetFileList 获取S3文件列表
+func (s *S3Storage) GetFileList() (map[string]*RemoteFile, error) {
+	return s.ListFiles("")
+}
+
+// GetFileAttrs 读取单个S3对象的元数据
+func (s *S3Storage) GetFileAttrs(remotePath string) (*RemoteFile, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.objectKey(remotePath), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	file := s.remoteFile(info)
+	file.Latest = true
+	return file, nil
+}
+
+// ListFiles 列出指定相对路径（文件或目录前缀）下的S3对象
+func (s *S3Storage) ListFiles(remotePath string) (map[string]*RemoteFile, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	// MinIO 在列表结果中返回对象元数据，其他S3兼容服务忽略该参数，需要时通过 GetFileAttrs 读取
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:       s.config.BackupPrefix + s.encryptor.ListPrefix(remotePath),
+		Recursive:    true,
+		WithMetadata: true,
+	})
+
+	fileMap := make(map[string]*RemoteFile)
+	for info := range objects {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+
+		relPath := s.relPath(info.Key)
+		if !matchesRemotePath(relPath, remotePath) {
+			continue
+		}
+
+		file := s.remoteFile(info)
+		file.Latest = true
+		addListedFile(fileMap, relPath, file)
+	}
+
+	return fileMap, nil
+}
+
+// ListFilesAsOf 列出指定时间点时每个对象的有效版本（需要bucket开启版本控制）
+func (s *S3Storage) ListFilesAsOf(remotePath string, asOf time.Time) (map[string]*RemoteFile, error) {
+	versions, err := s.ListFileVersions(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMap := make(map[string]*RemoteFile)
+	for relPath, fileVersions := range versions {
+		if file := versionAsOf(fileVersions, asOf); file != nil {
+			fileMap[relPath] = file
+		}
+	}
+
+	return fileMap, nil
+}
+
+// ListFileVersions 列出指定相对路径下每个对象的所有版本，删除标记作为隐藏版本返回
+func (s *S3Storage) ListFileVersions(remotePath string) (map[string][]*RemoteFile, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:       s.config.BackupPrefix + s.encryptor.ListPrefix(remotePath),
+		Recursive:    true,
+		WithVersions: true,
+		WithMetadata: true,
+	})
+
+	versions := make(map[string][]*RemoteFile)
+	for info := range objects {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+
+		relPath := s.relPath(info.Key)
+		if !matchesRemotePath(relPath, remotePath) {
+			continue
+		}
+
+		file := s.remoteFile(info)
+		if info.IsDeleteMarker {
+			file.Hidden = true
+			file.Latest = false
+		}
+		versions[relPath] = append(versions[relPath], file)
+	}
+
+	sortVersions(versions)
+	return versions, nil
+}
+
+// DownloadFile 下载S3对象到本地路径，返回解密后内容的SHA1校验和
+// 列表结果可能不包含对象元数据，因此下载时按读取到的元数据确定内容格式，并顺带补全 file.SHA1
+func (s *S3Storage) DownloadFile(file *RemoteFile, localPath string) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := minio.GetObjectOptions{}
+	if !file.Latest {
+		opts.VersionID = file.ID
+	}
+
+	obj, err := s.client.GetObject(ctx, s.bucket, s.fileKey(file), opts)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return "", err
+	}
+	file.Info = s3UserMetadata(info)
+	if file.SHA1 == "" {
+		file.SHA1 = s3Checksum(info)
+	}
+
+	checksum, encrypted, err := writeDownload(s.encryptor, obj, localPath, fileFormat(file.Info, info.LastModified))
+	if encrypted {
+		file.Encrypted = true
+		file.SHA1 = ""
+	}
+	return checksum, err
+}
+
+// PutBlob 上传对象到指定的完整对象名
+func (s *S3Storage) PutBlob(name string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+// GetBlob 读取指定完整对象名的内容
+func (s *S3Storage) GetBlob(name string) (io.ReadCloser, error) {
+	return s.client.GetObject(context.Background(), s.bucket, name, minio.GetObjectOptions{})
+}
+
+// GetBlobRange 读取指定完整对象名中的一段内容
+func (s *S3Storage) GetBlobRange(name string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(context.Background(), s.bucket, name, opts)
+}
+
+// ListBlobs 列出指定前缀下的对象
+func (s *S3Storage) ListBlobs(prefix string) (map[string]*RemoteFile, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+
+	blobs := make(map[string]*RemoteFile)
+	for info := range objects {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		blobs[info.Key] = &RemoteFile{
+			Path:            info.Key,
+			Size:            info.Size,
+			UploadTimestamp: info.LastModified,
+			Latest:          true,
+			handle:          info.Key,
+		}
+	}
+
+	return blobs, nil
+}
+
+// DeleteBlob 删除对象
+func (s *S3Storage) DeleteBlob(file *RemoteFile) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, file.Path, minio.RemoveObjectOptions{})
+}
+
+// Close S3客户端不需要显式关闭
+func (s *S3Storage) Close() error {
+	return nil
+}
+
+// 将S3对象信息转换为通用的远程文件信息
+func (s *S3Storage) remoteFile(info minio.ObjectInfo) *RemoteFile {
+	return &RemoteFile{
+		Path:            s.relPath(info.Key),
+		ID:              info.VersionID,
+		Size:            info.Size,
+		SHA1:            s3Checksum(info),
+		UploadTimestamp: info.LastModified,
+		Info:            s3UserMetadata(info),
+		Latest:          info.IsLatest,
+		Encrypted:       s3Metadata(info, encryptionInfoKey) != "",
+		handle:          info.Key,
+	}
+}
+
+// 获取相对路径对应的S3对象键，启用文件名加密时使用加密后的名称
+func (s *S3Storage) objectKey(relPath string) string {
+	return s.config.BackupPrefix + s.encryptor.EncryptName(relPath)
+}
+
+// 获取远程文件的S3对象键，列出的文件使用实际的键（可能是启用文件名加密前上传的）
+func (s *S3Storage) fileKey(file *RemoteFile) string {
+	if key, ok := file.handle.(string); ok {
+		return key
+	}
+	return s.objectKey(file.Path)
+}
+
+// 获取S3对象键对应的相对路径
+func (s *S3Storage) relPath(key string) string {
+	return s.encryptor.DecryptName(strings.TrimPrefix(key, s.config.BackupPrefix))
+}
+
+// 从对象元数据中读取内容SHA1（只有MinIO的列表结果包含元数据），加密对象记录的不是明文的SHA1，返回空
+func s3Checksum(info minio.ObjectInfo) string {
+	if s3Metadata(info, encryptionInfoKey) != "" {
+		return ""
+	}
+	return s3Metadata(info, s3ChecksumMetaKey)
+}
+
+// 读取对象的用户元数据，键不区分大小写，可以带 X-Amz-Meta- 前缀
+func s3Metadata(info minio.ObjectInfo, key string) string {
+	return s3UserMetadata(info)[strings.ToLower(key)]
+}
+
+// 返回对象的用户元数据，键去掉 X-Amz-Meta- 前缀并转换为小写（与上传时使用的键一致）
+func s3UserMetadata(info minio.ObjectInfo) map[string]string {
+	metadata := make(map[string]string, len(info.UserMetadata))
+	for k, value := range info.UserMetadata {
+		if len(k) > len(s3UserMetaPrefix) && strings.EqualFold(k[:len(s3UserMetaPrefix)], s3UserMetaPrefix) {
+			k = k[len(s3UserMetaPrefix):]
+		}
+		metadata[strings.ToLower(k)] = value
+	}
+	return metadata
+}
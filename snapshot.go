@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotSuffix  = ".snapshot"
+	snapshotVersion = 1
+)
+
+// 快照中文件的变化类型
+const (
+	SnapshotAdded    = "added"
+	SnapshotRemoved  = "removed"
+	SnapshotModified = "modified"
+)
+
+// Snapshot 快照清单，记录一次备份运行结束时备份中的全部文件，上传后不再修改
+type Snapshot struct {
+	Version      int             `json:"version"`
+	ID           string          `json:"id"`
+	Time         time.Time       `json:"time"`
+	Host         string          `json:"host"`
+	SourceDir    string          `json:"source_dir"`
+	BackupPrefix string          `json:"backup_prefix"`
+	Files        []*SnapshotFile `json:"files"` // 按路径排序
+
+	byPath map[string]*SnapshotFile
+}
+
+// SnapshotFile 快照中的一个文件
+type SnapshotFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum"`
+	RemoteID string    `json:"remote_id,omitempty"` // 远程文件版本ID，后端不支持版本时为空
+}
+
+// SnapshotChange 两个快照之间一个文件的变化
+type SnapshotChange struct {
+	Path   string
+	Change string // added, removed, modified
+}
+
+// SnapshotStore 快照存储，快照清单压缩、加密后存储在 SNAPSHOT_PREFIX 下
+type SnapshotStore struct {
+	config     Config
+	storage    Storage
+	blobs      BlobStorage
+	encryptor  *Encryptor
+	compressor *Compressor
+}
+
+// NewSnapshotStore 创建新的快照存储实例，storage 必须支持 BlobStorage
+func NewSnapshotStore(config Config, storage Storage) (*SnapshotStore, error) {
+	blobs, ok := blobStorageOf(storage)
+	if !ok {
+		return nil, fmt.Errorf("storage backend %s does not support snapshots", config.StorageBackend)
+	}
+	encryptor := encryptorOf(storage)
+	compressor, err := NewCompressor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotStore{
+		config:     config,
+		storage:    storage,
+		blobs:      blobs,
+		encryptor:  encryptor,
+		compressor: compressor,
+	}, nil
+}
+
+// Create 根据本地状态和当前的远程文件列表生成快照并上传
+// 只包含已备份且在远程存在的文件，远程文件ID来自上传完成后重新获取的列表
+func (s *SnapshotStore) Create(state *LocalState) (*Snapshot, error) {
+	remoteFiles, err := s.storage.GetFileList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote files: %v", err)
+	}
+
+	host, _ := os.Hostname()
+	snapshot := &Snapshot{
+		Version:      snapshotVersion,
+		ID:           newObjectID(),
+		Time:         time.Now().UTC(),
+		Host:         host,
+		SourceDir:    s.config.SourceDir,
+		BackupPrefix: s.config.BackupPrefix,
+	}
+
+	missing := 0
+	for relPath, fileState := range state.Files {
+		remoteFile, exists := remoteFiles[relPath]
+		if !fileState.BackedUp || !exists {
+			missing++
+			continue
+		}
+		snapshot.Files = append(snapshot.Files, &SnapshotFile{
+			Path:     relPath,
+			Size:     fileState.Size,
+			ModTime:  fileState.ModTime,
+			Checksum: fileState.Checksum,
+			RemoteID: remoteFile.ID,
+		})
+	}
+	if missing > 0 {
+		log.Printf("Snapshot: %d files in local state are not backed up and were left out", missing)
+	}
+	snapshot.index()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	data = s.compressor.EncodeBytes(data)
+	name := s.config.SnapshotPrefix + snapshot.ID + snapshotSuffix
+	content, size := s.encryptor.UploadReader(bytes.NewReader(data), int64(len(data)))
+	if err := s.blobs.PutBlob(name, content, size); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// List 列出所有快照对象，按快照ID（即创建时间）排序，键为快照ID
+func (s *SnapshotStore) List() ([]string, map[string]*RemoteFile, error) {
+	blobs, err := s.blobs.ListBlobs(s.config.SnapshotPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ids []string
+	snapshots := make(map[string]*RemoteFile)
+	for name, file := range blobs {
+		if !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, s.config.SnapshotPrefix), snapshotSuffix)
+		ids = append(ids, id)
+		snapshots[id] = file
+	}
+	sort.Strings(ids)
+	return ids, snapshots, nil
+}
+
+// Load 下载并解析快照，id 可以是完整ID、唯一的ID前缀或 latest
+func (s *SnapshotStore) Load(id string) (*Snapshot, error) {
+	ids, snapshots, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no snapshots found under %s", s.config.SnapshotPrefix)
+	}
+
+	var matches []string
+	switch {
+	case id == "latest":
+		matches = ids[len(ids)-1:]
+	case snapshots[id] != nil:
+		matches = []string{id}
+	default:
+		for _, candidate := range ids {
+			if strings.HasPrefix(candidate, id) {
+				matches = append(matches, candidate)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("snapshot %q not found", id)
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("snapshot %q is ambiguous (%d matches)", id, len(matches))
+	}
+
+	file := snapshots[matches[0]]
+	reader, err := s.blobs.GetBlob(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, _, err := openDownload(s.encryptor, reader, blobFormat(file.UploadTimestamp))
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(content).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %v", matches[0], err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	snapshot.index()
+	return snapshot, nil
+}
+
+// File 返回快照中指定路径的文件，不存在时返回 nil
+func (s *Snapshot) File(relPath string) *SnapshotFile {
+	return s.byPath[relPath]
+}
+
+// 按路径排序文件并建立路径索引
+func (s *Snapshot) index() {
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].Path < s.Files[j].Path
+	})
+	s.byPath = make(map[string]*SnapshotFile, len(s.Files))
+	for _, file := range s.Files {
+		s.byPath[file.Path] = file
+	}
+}
+
+// DiffSnapshots 比较两个快照，返回按路径排序的变化
+func DiffSnapshots(from, to *Snapshot) []SnapshotChange {
+	var changes []SnapshotChange
+	for _, file := range to.Files {
+		old := from.File(file.Path)
+		if old == nil {
+			changes = append(changes, SnapshotChange{Path: file.Path, Change: SnapshotAdded})
+		} else if old.Checksum != file.Checksum || old.Size != file.Size {
+			changes = append(changes, SnapshotChange{Path: file.Path, Change: SnapshotModified})
+		}
+	}
+	for _, file := range from.Files {
+		if to.File(file.Path) == nil {
+			changes = append(changes, SnapshotChange{Path: file.Path, Change: SnapshotRemoved})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// 返回按完整对象名存取对象的存储后端，分块和打包存储返回被包装的后端
+func blobStorageOf(storage Storage) (BlobStorage, bool) {
+	switch s := storage.(type) {
+	case *ChunkedStorage:
+		return s.blobs, true
+	case *PackedStorage:
+		return s.blobs, true
+	}
+	blobs, ok := storage.(BlobStorage)
+	return blobs, ok
+}
+
+// 返回存储后端使用的加密器（已读取仓库的盐），未启用加密时为 nil
+func encryptorOf(storage Storage) *Encryptor {
+	switch s := storage.(type) {
+	case *ChunkedStorage:
+		return s.encryptor
+	case *PackedStorage:
+		return s.encryptor
+	case *B2Storage:
+		return s.encryptor
+	case *S3Storage:
+		return s.encryptor
+	case *LocalStorage:
+		return s.encryptor
+	}
+	return nil
+}
+
+// 执行快照命令：list 列出快照，show 显示快照内容，diff 比较两个快照
+func runSnapshot(config Config, args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: snapshot list | snapshot show <id> | snapshot diff <from-id> <to-id>")
+	}
+	subcommand, args := args[0], args[1:]
+
+	flags := flag.NewFlagSet("snapshot "+subcommand, flag.ExitOnError)
+	flags.Parse(args)
+
+	// 验证必要配置
+	if err := validateStorageConfig(config); err != nil {
+		log.Fatalf("Missing required environment variables: %v", err)
+	}
+
+	storage, err := NewStorage(config)
+	if err != nil {
+		log.Fatalf("Storage initialization failed: %v", err)
+	}
+	defer storage.Close()
+
+	store, err := NewSnapshotStore(config, storage)
+	if err != nil {
+		log.Fatalf("Snapshot store initialization failed: %v", err)
+	}
+
+	switch subcommand {
+	case "list":
+		ids, snapshots, err := store.List()
+		if err != nil {
+			log.Fatalf("Failed to list snapshots: %v", err)
+		}
+		for _, id := range ids {
+			file := snapshots[id]
+			fmt.Printf("%s  %s  %d bytes\n", id, file.UploadTimestamp.Local().Format(time.RFC3339), file.Size)
+		}
+		log.Printf("%d snapshots under %s", len(ids), config.SnapshotPrefix)
+
+	case "show":
+		if flags.NArg() != 1 {
+			log.Fatal("Usage: snapshot show <id>")
+		}
+		snapshot, err := store.Load(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		var total int64
+		for _, file := range snapshot.Files {
+			total += file.Size
+		}
+		fmt.Printf("Snapshot:  %s\nTime:      %s\nHost:      %s\nSource:    %s\nPrefix:    %s\nFiles:     %d (%d bytes)\n\n",
+			snapshot.ID, snapshot.Time.Local().Format(time.RFC3339), snapshot.Host, snapshot.SourceDir,
+			snapshot.BackupPrefix, len(snapshot.Files), total)
+		for _, file := range snapshot.Files {
+			fmt.Printf("%s  %12d  %s  %s\n", file.Checksum, file.Size, file.ModTime.Local().Format(time.RFC3339), file.Path)
+		}
+
+	case "diff":
+		if flags.NArg() != 2 {
+			log.Fatal("Usage: snapshot diff <from-id> <to-id>")
+		}
+		from, err := store.Load(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		to, err := store.Load(flags.Arg(1))
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+
+		counts := make(map[string]int)
+		for _, change := range DiffSnapshots(from, to) {
+			marker := map[string]string{SnapshotAdded: "+", SnapshotRemoved: "-", SnapshotModified: "M"}[change.Change]
+			fmt.Printf("%s %s\n", marker, change.Path)
+			counts[change.Change]++
+		}
+		log.Printf("%s -> %s: %d added, %d removed, %d modified", from.ID, to.ID,
+			counts[SnapshotAdded], counts[SnapshotRemoved], counts[SnapshotModified])
+
+	default:
+		log.Fatalf("Unknown snapshot command: %s (available: list, show, diff)", subcommand)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 状态数据库中的 bucket
+var (
+	boltFilesBucket  = []byte("files")  // 路径 -> 文件状态（JSON）
+	boltStatusBucket = []byte("status") // 备份状态（0/1）+ 路径 -> 空，用于按状态查询
+	boltMetaBucket   = []byte("meta")   // 文件以外的状态
+)
+
+// meta bucket 中保存文件以外状态的键
+var boltStateKey = []byte("state")
+
+// boltStateStore 嵌入式键值数据库（bbolt）状态存储
+// 每个文件的状态单独存储，保存时只编码和写入上次保存之后修改过的条目，检查点的耗时和磁盘写入量与变化的文件数成正比；
+// 每次保存在一个事务中完成，写入中断时数据库保持上一次保存的内容
+type boltStateStore struct {
+	path        string
+	jsonPath    string // 迁移来源：STATE_STORE=json 时的状态文件
+	generations int
+	db          *bolt.DB
+}
+
+// 打开状态数据库，其他进程正在使用时等待一段时间后返回错误
+func newBoltStateStore(config Config) (*boltStateStore, error) {
+	path := boltStatePath(config.LocalStatePath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltFilesBucket, boltStatusBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state database %s: %v", path, err)
+	}
+
+	return &boltStateStore{
+		path:        path,
+		jsonPath:    config.LocalStatePath,
+		generations: config.StateGenerations,
+		db:          db,
+	}, nil
+}
+
+// 状态数据库路径：LOCAL_STATE_PATH 的扩展名替换为 .db，如 state.json -> state.db
+func boltStatePath(statePath string) string {
+	return strings.TrimSuffix(statePath, filepath.Ext(statePath)) + ".db"
+}
+
+// Load 加载状态，数据库为空且存在JSON状态文件时先迁移
+// 扫描时需要与全部文件比较并查找已删除的文件，文件条目通过游标逐条解码到文件表中
+func (s *boltStateStore) Load() (*LocalState, error) {
+	if migrated, err := s.migrateJSON(); err != nil || migrated != nil {
+		return migrated, err
+	}
+
+	state := &LocalState{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(boltMetaBucket).Get(boltStateKey); meta != nil {
+			if err := json.Unmarshal(meta, state); err != nil {
+				return fmt.Errorf("invalid state metadata: %v", err)
+			}
+		}
+
+		state.Files = make(map[string]*FileState)
+		cursor := tx.Bucket(boltFilesBucket).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			fileState := &FileState{}
+			if err := json.Unmarshal(value, fileState); err != nil {
+				return fmt.Errorf("invalid state entry %s: %v", key, err)
+			}
+			state.Files[string(key)] = fileState
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state database %s: %v", s.path, err)
+	}
+	state.tracked = true
+	return state, nil
+}
+
+// Save 在一个事务中写入上次保存之后修改或删除的文件状态（调用方需持有 state.mu）
+// 不是从数据库加载的状态（如迁移或重建的状态）与数据库中的全部条目比较后写入
+func (s *boltStateStore) Save(state *LocalState, final bool) error {
+	// 文件以外的状态单独编码，编码期间临时去掉文件表
+	files := state.Files
+	state.Files = nil
+	meta, err := json.Marshal(state)
+	state.Files = files
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if state.tracked {
+			err = s.putDirtyFiles(tx, files, state.dirty)
+		} else {
+			err = s.putAllFiles(tx, files)
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltMetaBucket).Put(boltStateKey, meta)
+	})
+	if err != nil {
+		return err
+	}
+
+	state.dirty = nil
+	state.tracked = true
+	return nil
+}
+
+// 写入修改过的文件状态，文件表中已不存在的删除
+func (s *boltStateStore) putDirtyFiles(tx *bolt.Tx, files map[string]*FileState, dirty map[string]bool) error {
+	filesBucket := tx.Bucket(boltFilesBucket)
+	statusBucket := tx.Bucket(boltStatusBucket)
+	for relPath := range dirty {
+		if err := boltPutFile(filesBucket, statusBucket, relPath, files[relPath]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写入与数据库中不同的全部文件状态，删除文件表中不存在的条目
+func (s *boltStateStore) putAllFiles(tx *bolt.Tx, files map[string]*FileState) error {
+	filesBucket := tx.Bucket(boltFilesBucket)
+	statusBucket := tx.Bucket(boltStatusBucket)
+	for relPath, fileState := range files {
+		if err := boltPutFile(filesBucket, statusBucket, relPath, fileState); err != nil {
+			return err
+		}
+	}
+
+	// 游标遍历时删除会跳过条目，先收集再删除
+	var removed []string
+	err := filesBucket.ForEach(func(key, _ []byte) error {
+		if _, exists := files[string(key)]; !exists {
+			removed = append(removed, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, relPath := range removed {
+		if err := boltPutFile(filesBucket, statusBucket, relPath, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupFile 按路径查询单个文件的状态
+func (s *boltStateStore) LookupFile(relPath string) (*FileState, error) {
+	var fileState *FileState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltFilesBucket).Get([]byte(relPath))
+		if value == nil {
+			return nil
+		}
+		fileState = &FileState{}
+		return json.Unmarshal(value, fileState)
+	})
+	return fileState, err
+}
+
+// FilesByStatus 通过状态索引查询已备份或未备份的文件，按路径排序
+func (s *boltStateStore) FilesByStatus(backedUp bool) ([]*FileState, error) {
+	var files []*FileState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		filesBucket := tx.Bucket(boltFilesBucket)
+		prefix := boltStatusKey(backedUp, "")
+
+		cursor := tx.Bucket(boltStatusBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			value := filesBucket.Get(key[len(prefix):])
+			if value == nil {
+				continue
+			}
+			fileState := &FileState{}
+			if err := json.Unmarshal(value, fileState); err != nil {
+				return err
+			}
+			files = append(files, fileState)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Path 返回状态数据库路径
+func (s *boltStateStore) Path() string {
+	return s.path
+}
+
+// Close 关闭状态数据库
+func (s *boltStateStore) Close() error {
+	return s.db.Close()
+}
+
+// 数据库从未保存过且存在JSON状态文件时，将其导入数据库并重命名为 .migrated
+// 没有需要迁移的内容时返回 nil
+func (s *boltStateStore) migrateJSON() (*LocalState, error) {
+	if s.jsonPath == s.path {
+		return nil, nil
+	}
+
+	saved := false
+	s.db.View(func(tx *bolt.Tx) error {
+		saved = tx.Bucket(boltMetaBucket).Get(boltStateKey) != nil
+		return nil
+	})
+	if saved {
+		return nil, nil
+	}
+	if _, err := os.Stat(s.jsonPath); err != nil {
+		return nil, nil
+	}
+
+	state, err := newJSONStateStore(s.jsonPath, s.generations).Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s for migration: %v", s.jsonPath, err)
+	}
+	if state.Version > stateVersion {
+		return nil, fmt.Errorf("cannot migrate %s: state schema version %d is newer than the supported version %d", s.jsonPath, state.Version, stateVersion)
+	}
+	if err := s.Save(state, true); err != nil {
+		return nil, fmt.Errorf("failed to migrate %s: %v", s.jsonPath, err)
+	}
+	if err := os.Rename(s.jsonPath, s.jsonPath+".migrated"); err != nil {
+		log.Printf("Warning: Could not rename migrated state file %s: %v", s.jsonPath, err)
+	}
+
+	log.Printf("Migrated %d files from %s to state database %s", len(state.Files), s.jsonPath, s.path)
+	return state, nil
+}
+
+// 写入单个文件的状态并更新状态索引，fileState 为 nil 时删除；内容与数据库中相同时不写入
+func boltPutFile(filesBucket, statusBucket *bolt.Bucket, relPath string, fileState *FileState) error {
+	key := []byte(relPath)
+	old := filesBucket.Get(key)
+
+	var value []byte
+	if fileState != nil {
+		var err error
+		if value, err = json.Marshal(fileState); err != nil {
+			return err
+		}
+		if bytes.Equal(old, value) {
+			return nil
+		}
+	}
+
+	if old != nil {
+		if err := statusBucket.Delete(boltStatusKey(boltBackedUp(old), relPath)); err != nil {
+			return err
+		}
+	}
+	if fileState == nil {
+		return filesBucket.Delete(key)
+	}
+	if err := filesBucket.Put(key, value); err != nil {
+		return err
+	}
+	return statusBucket.Put(boltStatusKey(fileState.BackedUp, relPath), nil)
+}
+
+// 状态索引的键：备份状态 + 路径
+func boltStatusKey(backedUp bool, relPath string) []byte {
+	status := byte('0')
+	if backedUp {
+		status = '1'
+	}
+	return append([]byte{status}, relPath...)
+}
+
+// 从编码后的文件状态中读取备份状态
+func boltBackedUp(value []byte) bool {
+	var fileState struct {
+		BackedUp bool `json:"backed_up"`
+	}
+	json.Unmarshal(value, &fileState)
+	return fileState.BackedUp
+}
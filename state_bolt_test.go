@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+// 从数据库加载的状态只写入修改或删除的条目，迁移或重建的状态完整写入
+func TestBoltStateStoreDirtySave(t *testing.T) {
+	config := newTestConfig(t)
+	config.StateStore = StateStoreBolt
+	store, err := newBoltStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	state := &LocalState{Files: map[string]*FileState{
+		"a.txt": {Path: "a.txt", Checksum: "a", BackedUp: true},
+		"b.txt": {Path: "b.txt", Checksum: "b", BackedUp: true},
+		"c.txt": {Path: "c.txt", Checksum: "c"},
+	}}
+	if err := store.Save(state, true); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Files) != 3 {
+		t.Fatalf("loaded %d files, want 3", len(loaded.Files))
+	}
+
+	stateManager := &StateManager{config: config, store: store}
+	loaded.Files["c.txt"].BackedUp = true
+	loaded.markDirty("c.txt")
+	stateManager.RemoveFile(loaded, "b.txt")
+	loaded.Files["a.txt"].Checksum = "not marked"
+	if err := store.Save(loaded, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if fileState, _ := store.LookupFile("b.txt"); fileState != nil {
+		t.Error("removed b.txt is still in the database")
+	}
+	if fileState, _ := store.LookupFile("a.txt"); fileState == nil || fileState.Checksum != "a" {
+		t.Errorf("a.txt = %+v, want the saved entry untouched", fileState)
+	}
+	pending, err := store.FilesByStatus(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d files still pending after c.txt was marked backed up", len(pending))
+	}
+
+	// 新建的状态与数据库完整比较
+	rebuilt := &LocalState{Files: map[string]*FileState{
+		"d.txt": {Path: "d.txt", Checksum: "d", BackedUp: true},
+	}}
+	if err := store.Save(rebuilt, true); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Files) != 1 || loaded.Files["d.txt"] == nil {
+		t.Errorf("files after saving a rebuilt state = %v, want only d.txt", loaded.Files)
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -9,64 +9,125 @@ import (
 
 // StateManager 状态管理器结构体
 type StateManager struct {
-	config Config
+	config   Config
+	store    StateStore
+	storeErr error // 打开状态存储失败时的错误，加载状态时返回
 }
 
 // NewStateManager 创建新的状态管理器实例
 func NewStateManager(config Config) *StateManager {
+	store, err := newStateStore(config)
 	return &StateManager{
-		config: config,
+		config:   config,
+		store:    store,
+		storeErr: err,
 	}
 }
 
-// LoadState 加载本地状态
+// LoadState 加载本地状态，旧版本的状态会升级到当前版本
 func (sm *StateManager) LoadState() (*LocalState, error) {
-	state := &LocalState{
-		Files: make(map[string]*FileState),
+	if sm.storeErr != nil {
+		return nil, sm.storeErr
 	}
-
-	if sm.config.LocalStatePath == "" {
-		return state, nil
+	state, err := sm.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.upgradeState(state); err != nil {
+		return nil, err
 	}
+	return state, nil
+}
 
-	file, err := os.Open(sm.config.LocalStatePath)
+// 持有运行锁加载本地状态，加载后关闭状态存储并释放锁，用于只读取状态的命令（如恢复）
+// 加载时可能升级状态结构或从JSON状态文件迁移到数据库，不能与正在进行的备份同时写入；
+// 状态数据库在备份期间被独占打开，持有锁时才打开可以立即报告冲突而不是等待超时
+func loadStateLocked(config Config, command string) (*LocalState, error) {
+	runLock, err := AcquireRunLock(config, command)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return state, nil // 文件不存在时返回空状态
-		}
 		return nil, err
 	}
-	defer file.Close()
+	defer runLock.Release()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(state); err != nil {
-		return nil, err
+	stateManager := NewStateManager(config)
+	defer stateManager.Close()
+	return stateManager.LoadState()
+}
+
+// 把加载的状态升级到当前版本并立即保存，升级前先备份原状态文件
+func (sm *StateManager) upgradeState(state *LocalState) error {
+	if state.Version == stateVersion {
+		return nil
+	}
+	if state.Version > stateVersion {
+		_, err := migrateState(state)
+		return fmt.Errorf("cannot load %s: %v", sm.GetStatePath(), err)
 	}
 
-	return state, nil
+	// 新建的空状态没有需要升级的内容
+	if stateIsEmpty(state) {
+		state.Version = stateVersion
+		return nil
+	}
+
+	if err := sm.BackupState(); err != nil {
+		return fmt.Errorf("failed to back up %s before migration: %v", sm.GetStatePath(), err)
+	}
+	from := state.Version
+	if _, err := migrateState(state); err != nil {
+		return fmt.Errorf("cannot load %s: %v", sm.GetStatePath(), err)
+	}
+	if err := sm.store.Save(state, false); err != nil {
+		return fmt.Errorf("failed to save migrated state: %v", err)
+	}
+
+	log.Printf("Local state %s upgraded from schema version %d to %d", sm.GetStatePath(), from, stateVersion)
+	return nil
 }
 
 // SaveState 保存本地状态
 func (sm *StateManager) SaveState(state *LocalState) error {
-	if sm.config.LocalStatePath == "" {
-		return nil
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if sm.storeErr != nil {
+		return sm.storeErr
 	}
+	state.Version = stateVersion
+	return sm.store.Save(state, true)
+}
 
-	// 确保目录存在
-	dir := sm.getStateDirectory()
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+// 保存运行过程中的检查点和续传记录（调用方需持有 state.mu）
+func (sm *StateManager) writeState(state *LocalState) error {
+	if sm.storeErr != nil {
+		return sm.storeErr
 	}
+	state.Version = stateVersion
+	return sm.store.Save(state, false)
+}
 
-	file, err := os.Create(sm.config.LocalStatePath)
-	if err != nil {
-		return err
+// QueryFile 从已保存的状态中查询单个文件，不存在时返回 nil
+func (sm *StateManager) QueryFile(relPath string) (*FileState, error) {
+	if sm.storeErr != nil {
+		return nil, sm.storeErr
 	}
-	defer file.Close()
+	return sm.store.LookupFile(relPath)
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(state)
+// QueryFilesByStatus 从已保存的状态中查询已备份或未备份的文件
+func (sm *StateManager) QueryFilesByStatus(backedUp bool) ([]*FileState, error) {
+	if sm.storeErr != nil {
+		return nil, sm.storeErr
+	}
+	return sm.store.FilesByStatus(backedUp)
+}
+
+// Close 关闭状态存储
+func (sm *StateManager) Close() error {
+	if sm.store == nil {
+		return nil
+	}
+	return sm.store.Close()
 }
 
 // UpdateLastBackupTime 更新最后备份时间
@@ -82,11 +143,13 @@ func (sm *StateManager) GetLastBackupTime(state *LocalState) time.Time {
 // AddFile 添加文件到状态
 func (sm *StateManager) AddFile(state *LocalState, fileState *FileState) {
 	state.Files[fileState.Path] = fileState
+	state.markDirty(fileState.Path)
 }
 
 // RemoveFile 从状态中移除文件
 func (sm *StateManager) RemoveFile(state *LocalState, filePath string) {
 	delete(state.Files, filePath)
+	state.markDirty(filePath)
 }
 
 // GetFile 获取文件状态
@@ -98,6 +161,7 @@ func (sm *StateManager) GetFile(state *LocalState, filePath string) (*FileState,
 // UpdateFile 更新文件状态
 func (sm *StateManager) UpdateFile(state *LocalState, fileState *FileState) {
 	state.Files[fileState.Path] = fileState
+	state.markDirty(fileState.Path)
 }
 
 // GetAllFiles 获取所有文件状态
@@ -114,23 +178,24 @@ func (sm *StateManager) GetFileCount(state *LocalState) int {
 func (sm *StateManager) ClearState(state *LocalState) {
 	state.Files = make(map[string]*FileState)
 	state.LastBackup = time.Time{}
+	state.tracked = false
 }
 
 // BackupState 备份状态文件
 func (sm *StateManager) BackupState() error {
-	if sm.config.LocalStatePath == "" {
+	if sm.GetStatePath() == "" {
 		return nil
 	}
 
 	// 检查状态文件是否存在
-	if _, err := os.Stat(sm.config.LocalStatePath); os.IsNotExist(err) {
+	if _, err := os.Stat(sm.GetStatePath()); os.IsNotExist(err) {
 		return nil // 文件不存在，无需备份
 	}
 
-	backupPath := sm.config.LocalStatePath + ".backup"
+	backupPath := sm.GetStatePath() + ".backup"
 	
 	// 读取原文件
-	originalData, err := os.ReadFile(sm.config.LocalStatePath)
+	originalData, err := os.ReadFile(sm.GetStatePath())
 	if err != nil {
 		return err
 	}
@@ -146,11 +211,11 @@ func (sm *StateManager) BackupState() error {
 
 // RestoreState 恢复状态文件
 func (sm *StateManager) RestoreState() error {
-	if sm.config.LocalStatePath == "" {
+	if sm.GetStatePath() == "" {
 		return nil
 	}
 
-	backupPath := sm.config.LocalStatePath + ".backup"
+	backupPath := sm.GetStatePath() + ".backup"
 	
 	// 检查备份文件是否存在
 	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
@@ -164,7 +229,7 @@ func (sm *StateManager) RestoreState() error {
 	}
 
 	// 写入原文件
-	if err := os.WriteFile(sm.config.LocalStatePath, backupData, 0644); err != nil {
+	if err := os.WriteFile(sm.GetStatePath(), backupData, 0644); err != nil {
 		return err
 	}
 
@@ -172,19 +237,10 @@ func (sm *StateManager) RestoreState() error {
 	return nil
 }
 
-// GetStatePath 获取状态文件路径
+// GetStatePath 获取状态文件路径（bolt 存储时为数据库路径）
 func (sm *StateManager) GetStatePath() string {
-	return sm.config.LocalStatePath
-}
-
-// 获取状态文件目录
-func (sm *StateManager) getStateDirectory() string {
-	// 从完整路径中提取目录部分
-	dir := sm.config.LocalStatePath
-	for i := len(dir) - 1; i >= 0; i-- {
-		if dir[i] == '/' || dir[i] == '\\' {
-			return dir[:i]
-		}
+	if sm.store == nil {
+		return sm.config.LocalStatePath
 	}
-	return "."
+	return sm.store.Path()
 } 
\ No newline at end of file
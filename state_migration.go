@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// 当前的状态结构版本，修改 LocalState 或 FileState 的结构时递增，并在 stateMigrations 中添加对应的升级步骤
+const stateVersion = 1
+
+// stateMigration 把状态从 from 版本升级到 from+1 版本
+type stateMigration struct {
+	from        int
+	description string
+	migrate     func(state *LocalState) error
+}
+
+// 按版本顺序排列的升级步骤
+var stateMigrations = []stateMigration{
+	{from: 0, description: "add schema version to unversioned state", migrate: migrateStateV0},
+}
+
+// 版本0：加入版本字段之前的状态文件，结构与版本1相同
+// 以文件表的键为准补全缺失的路径，去掉空条目
+func migrateStateV0(state *LocalState) error {
+	for relPath, fileState := range state.Files {
+		if fileState == nil {
+			delete(state.Files, relPath)
+			state.markDirty(relPath)
+			continue
+		}
+		if fileState.Path == "" {
+			fileState.Path = relPath
+			state.markDirty(relPath)
+		}
+	}
+	return nil
+}
+
+// 检查状态版本，旧版本依次执行升级步骤，返回是否进行了升级
+// 版本比当前程序支持的更新时返回错误，避免按旧结构误读后覆盖
+func migrateState(state *LocalState) (bool, error) {
+	if state.Version > stateVersion {
+		return false, fmt.Errorf("state schema version %d is newer than the supported version %d, upgrade b2-backup to use this state", state.Version, stateVersion)
+	}
+	if state.Version < 0 {
+		return false, fmt.Errorf("invalid state schema version %d", state.Version)
+	}
+
+	migrated := false
+	for state.Version < stateVersion {
+		migration, ok := findStateMigration(state.Version)
+		if !ok {
+			return migrated, fmt.Errorf("no migration from state schema version %d", state.Version)
+		}
+		if err := migration.migrate(state); err != nil {
+			return migrated, fmt.Errorf("state migration from version %d (%s) failed: %v", migration.from, migration.description, err)
+		}
+		log.Printf("State migrated from schema version %d to %d: %s", migration.from, migration.from+1, migration.description)
+		state.Version = migration.from + 1
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// 查找从指定版本开始的升级步骤
+func findStateMigration(from int) (stateMigration, bool) {
+	for _, migration := range stateMigrations {
+		if migration.from == from {
+			return migration, true
+		}
+	}
+	return stateMigration{}, false
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateRebuilder 从远程备份重建本地状态，用于状态文件丢失或更换主机后继续增量备份
+// 优先使用最新的快照（包含原始的大小、修改时间和校验和）；快照中没有的文件使用远程记录的内容SHA1。
+// 重建的条目都标记为已备份，下次扫描时大小和修改时间不一致的文件会重新计算校验和，
+// 内容与远程一致的只更新状态，不一致的才上传
+type StateRebuilder struct {
+	config  Config
+	storage Storage
+}
+
+// NewStateRebuilder 创建新的状态重建器实例
+func NewStateRebuilder(config Config, storage Storage) *StateRebuilder {
+	return &StateRebuilder{
+		config:  config,
+		storage: storage,
+	}
+}
+
+// Rebuild 根据远程文件列表和最新的快照重建本地状态
+func (r *StateRebuilder) Rebuild() (*LocalState, error) {
+	remoteFiles, err := r.storage.GetFileList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote files: %v", err)
+	}
+
+	state := &LocalState{Files: make(map[string]*FileState)}
+
+	// 快照中的条目只在远程仍是同一版本时使用，之后被更新的文件按远程列表处理
+	fromSnapshot := 0
+	snapshot, err := r.latestSnapshot()
+	if err != nil {
+		log.Printf("Warning: Could not read snapshots, rebuilding from the remote listing only: %v", err)
+	}
+	if snapshot != nil {
+		for _, entry := range snapshot.Files {
+			remoteFile, exists := remoteFiles[entry.Path]
+			if !exists || (entry.RemoteID != "" && remoteFile.ID != entry.RemoteID) {
+				continue
+			}
+			state.Files[entry.Path] = &FileState{
+				Path:     entry.Path,
+				Size:     entry.Size,
+				ModTime:  entry.ModTime,
+				Checksum: entry.Checksum,
+				BackedUp: true,
+			}
+			fromSnapshot++
+		}
+	}
+
+	// 分块模式下列表中的SHA1是分块清单的，不能代表文件内容
+	fromListing, unknown := 0, 0
+	for relPath, remoteFile := range remoteFiles {
+		if _, exists := state.Files[relPath]; exists {
+			continue
+		}
+		if r.config.RepositoryMode == RepositoryModeChunked {
+			unknown++
+			continue
+		}
+		// 部分后端（如S3）的列表结果不包含对象元数据，逐个读取
+		if remoteFile.SHA1 == "" && !remoteFile.Encrypted {
+			if attrs, err := r.storage.GetFileAttrs(relPath); err != nil {
+				log.Printf("Warning: Could not read attributes of %s: %v", relPath, err)
+			} else if attrs.ID == remoteFile.ID {
+				remoteFile.SHA1 = attrs.SHA1
+			}
+		}
+		if remoteFile.SHA1 == "" {
+			unknown++
+			continue
+		}
+		state.Files[relPath] = &FileState{
+			Path:     relPath,
+			Size:     remoteFile.Size,
+			ModTime:  r.localModTime(relPath, remoteFile),
+			Checksum: remoteFile.SHA1,
+			BackedUp: true,
+		}
+		fromListing++
+	}
+
+	if snapshot != nil {
+		log.Printf("Rebuilt %d files from snapshot %s", fromSnapshot, snapshot.ID)
+	}
+	log.Printf("Rebuilt %d files from remote content checksums", fromListing)
+	if unknown > 0 {
+		log.Printf("Warning: %d remote files have no usable content checksum and will be uploaded again if they exist locally", unknown)
+	}
+	return state, nil
+}
+
+// 读取最新的快照，没有快照时返回 nil
+func (r *StateRebuilder) latestSnapshot() (*Snapshot, error) {
+	store, err := NewSnapshotStore(r.config, r.storage)
+	if err != nil {
+		return nil, err
+	}
+	ids, _, err := store.List()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return store.Load(ids[len(ids)-1])
+}
+
+// 远程记录的修改时间只精确到毫秒，与本地文件一致时使用本地的精确时间，扫描时不必重新计算校验和；
+// 不一致或没有记录时返回远程的值，扫描时会重新计算校验和
+func (r *StateRebuilder) localModTime(relPath string, remoteFile *RemoteFile) time.Time {
+	info, err := os.Stat(filepath.Join(r.config.SourceDir, filepath.FromSlash(relPath)))
+	if err != nil || remoteFile.LastModified.IsZero() || info.Size() != remoteFile.Size {
+		return remoteFile.LastModified
+	}
+	if info.ModTime().Truncate(time.Millisecond).Equal(remoteFile.LastModified.Truncate(time.Millisecond)) {
+		return info.ModTime()
+	}
+	return remoteFile.LastModified
+}
+
+// 创建存储后端并重建本地状态
+func rebuildState(config Config) (*LocalState, error) {
+	storage, err := NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	return NewStateRebuilder(config, storage).Rebuild()
+}
+
+// 检查本地状态是否为空（状态文件不存在或从未完成过备份）
+func stateIsEmpty(state *LocalState) bool {
+	return len(state.Files) == 0 && state.LastBackup.IsZero()
+}
+
+// 执行状态命令：rebuild 从远程备份重建本地状态，list 按备份状态列出文件，show 显示单个文件的状态
+func runState(config Config, args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: state rebuild [-force] [-dry-run] | state list [-status pending|backed-up] | state show <path>")
+	}
+
+	switch args[0] {
+	case "rebuild":
+		runStateRebuild(config, args[1:])
+	case "list":
+		runStateList(config, args[1:])
+	case "show":
+		runStateShow(config, args[1:])
+	default:
+		log.Fatalf("Unknown state command: %s (available: rebuild, list, show)", args[0])
+	}
+}
+
+// 从远程备份重建本地状态
+func runStateRebuild(config Config, args []string) {
+	flags := flag.NewFlagSet("state rebuild", flag.ExitOnError)
+	force := flags.Bool("force", false, "replace an existing non-empty state file (a copy is kept as .backup)")
+	dryRun := flags.Bool("dry-run", false, "report what would be rebuilt without writing the state file")
+	flags.Parse(args)
+
+	// 验证必要配置
+	if config.SourceDir == "" {
+		log.Fatal("Missing required environment variables: SOURCE_DIR is required")
+	}
+	if err := validateStorageConfig(config); err != nil {
+		log.Fatalf("Missing required environment variables: %v", err)
+	}
+
+	// 备份运行中重建会被其结束时保存的状态覆盖
+	var runLock *RunLock
+	if !*dryRun {
+		var err error
+		if runLock, err = AcquireRunLock(config, "state rebuild"); err != nil {
+			log.Fatalf("State rebuild not started: %v", err)
+		}
+		defer runLock.Release()
+	}
+
+	stateManager := NewStateManager(config)
+	defer stateManager.Close()
+	existing, err := stateManager.LoadState()
+	if err != nil && !*force {
+		runLock.Fatalf("Failed to load local state: %v (use -force to replace it)", err)
+	}
+	if err == nil && !stateIsEmpty(existing) && !*force && !*dryRun {
+		runLock.Fatalf("Local state %s already contains %d files (use -force to replace it)", stateManager.GetStatePath(), len(existing.Files))
+	}
+
+	log.Printf("Rebuilding local state from %s storage...", config.StorageBackend)
+	state, err := rebuildState(config)
+	if err != nil {
+		runLock.Fatalf("State rebuild failed: %v", err)
+	}
+
+	if *dryRun {
+		log.Printf("Dry run: state with %d files would be written to %s", len(state.Files), stateManager.GetStatePath())
+		return
+	}
+
+	if err := stateManager.BackupState(); err != nil {
+		runLock.Fatalf("Failed to back up existing state: %v", err)
+	}
+	if err := stateManager.SaveState(state); err != nil {
+		runLock.Fatalf("Failed to save local state: %v", err)
+	}
+	log.Printf("Local state with %d files saved to %s", len(state.Files), stateManager.GetStatePath())
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 状态存储类型
+const (
+	StateStoreJSON = "json" // 单个JSON文件（默认），每次保存重写整个文件
+	StateStoreBolt = "bolt" // 嵌入式键值数据库，每次保存只写入变化的文件
+)
+
+// StateStore 本地状态的持久化存储
+type StateStore interface {
+	// Load 加载全部状态
+	Load() (*LocalState, error)
+	// Save 保存状态，final 为 false 表示运行过程中的检查点（调用方需持有 state.mu）
+	Save(state *LocalState, final bool) error
+	// LookupFile 按路径查询单个文件的已保存状态，不存在时返回 nil
+	LookupFile(relPath string) (*FileState, error)
+	// FilesByStatus 查询已保存状态中已备份或未备份的文件，按路径排序
+	FilesByStatus(backedUp bool) ([]*FileState, error)
+	// Path 返回状态存储的文件路径
+	Path() string
+	// Close 释放状态存储资源
+	Close() error
+}
+
+// 记录文件状态在上次保存之后被修改或删除，修改 Files 中的条目后调用
+func (state *LocalState) markDirty(relPath string) {
+	if state.dirty == nil {
+		state.dirty = make(map[string]bool)
+	}
+	state.dirty[relPath] = true
+}
+
+// 根据配置创建状态存储
+func newStateStore(config Config) (StateStore, error) {
+	switch config.StateStore {
+	case "", StateStoreJSON:
+		return newJSONStateStore(config.LocalStatePath, config.StateGenerations), nil
+	case StateStoreBolt:
+		if config.LocalStatePath == "" {
+			return newJSONStateStore("", 0), nil
+		}
+		return newBoltStateStore(config)
+	default:
+		return nil, fmt.Errorf("unknown STATE_STORE %q (json or bolt)", config.StateStore)
+	}
+}
+
+// jsonStateStore 单个JSON文件的状态存储
+type jsonStateStore struct {
+	path        string
+	generations int // 保留的历史状态文件代数
+}
+
+func newJSONStateStore(path string, generations int) *jsonStateStore {
+	return &jsonStateStore{path: path, generations: generations}
+}
+
+// Load 加载状态文件
+// 状态文件不存在或无法解析时（如写入时断电）依次尝试之前保存的各代状态文件
+func (s *jsonStateStore) Load() (*LocalState, error) {
+	if s.path == "" {
+		return &LocalState{Files: make(map[string]*FileState)}, nil
+	}
+
+	state, err := s.readState(s.path)
+	if err == nil {
+		return state, nil
+	}
+
+	for i := 1; i <= s.generations; i++ {
+		path := s.generationPath(i)
+		generation, genErr := s.readState(path)
+		if genErr != nil {
+			continue
+		}
+		if os.IsNotExist(err) {
+			log.Printf("Warning: State file %s is missing, using previous generation %s", s.path, path)
+		} else {
+			log.Printf("Warning: State file %s is unreadable (%v), using previous generation %s", s.path, err, path)
+		}
+		return generation, nil
+	}
+
+	if os.IsNotExist(err) {
+		return &LocalState{Files: make(map[string]*FileState)}, nil // 文件不存在时返回空状态
+	}
+	return nil, err
+}
+
+// 读取并解析状态文件
+func (s *jsonStateStore) readState(path string) (*LocalState, error) {
+	state := &LocalState{
+		Files: make(map[string]*FileState),
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*FileState)
+	}
+
+	return state, nil
+}
+
+// Save 原子地写入状态文件：先写入临时文件并同步到磁盘，再重命名为状态文件，
+// 写入过程中断电或磁盘写满时原来的状态文件不受影响；运行结束时的保存会把之前的状态文件保留为历史版本
+func (s *jsonStateStore) Save(state *LocalState, final bool) error {
+	if s.path == "" {
+		return nil
+	}
+
+	// 确保目录存在
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if final {
+		s.rotateGenerations()
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// 同步目录，保证重命名已写入磁盘（Windows 不支持同步目录，忽略错误）
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	state.dirty = nil
+	return nil
+}
+
+// LookupFile 读取状态文件并查找单个文件
+func (s *jsonStateStore) LookupFile(relPath string) (*FileState, error) {
+	state, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	return state.Files[relPath], nil
+}
+
+// FilesByStatus 读取状态文件并按备份状态过滤
+func (s *jsonStateStore) FilesByStatus(backedUp bool) ([]*FileState, error) {
+	state, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	return filterFilesByStatus(state.Files, backedUp), nil
+}
+
+// Path 返回状态文件路径
+func (s *jsonStateStore) Path() string {
+	return s.path
+}
+
+// Close JSON状态文件不需要释放资源
+func (s *jsonStateStore) Close() error {
+	return nil
+}
+
+// 将当前状态文件移动为第1代，之前的各代依次后移，超出 STATE_GENERATIONS 的被覆盖
+func (s *jsonStateStore) rotateGenerations() {
+	if s.generations <= 0 {
+		return
+	}
+	for i := s.generations - 1; i >= 1; i-- {
+		os.Rename(s.generationPath(i), s.generationPath(i+1))
+	}
+	if err := os.Rename(s.path, s.generationPath(1)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not keep previous state generation: %v", err)
+	}
+}
+
+// 获取第 n 代历史状态文件的路径，1为最近一代
+func (s *jsonStateStore) generationPath(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// 按备份状态过滤文件，结果按路径排序
+func filterFilesByStatus(files map[string]*FileState, backedUp bool) []*FileState {
+	var result []*FileState
+	for _, fileState := range files {
+		if fileState.BackedUp == backedUp {
+			result = append(result, fileState)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+// 按备份状态列出已保存状态中的文件
+func runStateList(config Config, args []string) {
+	flags := flag.NewFlagSet("state list", flag.ExitOnError)
+	status := flags.String("status", "pending", "which files to list: pending (not yet backed up) or backed-up")
+	flags.Parse(args)
+
+	var backedUp bool
+	switch *status {
+	case "pending":
+	case "backed-up":
+		backedUp = true
+	default:
+		log.Fatalf("Invalid -status %q (expected pending or backed-up)", *status)
+	}
+
+	// 备份期间状态数据库被独占打开，先获取运行锁以便立即报告冲突
+	runLock, err := AcquireRunLock(config, "state list")
+	if err != nil {
+		log.Fatalf("Cannot read the local state: %v", err)
+	}
+	defer runLock.Release()
+
+	stateManager := NewStateManager(config)
+	defer stateManager.Close()
+
+	files, err := stateManager.QueryFilesByStatus(backedUp)
+	if err != nil {
+		runLock.Fatalf("Failed to query local state: %v", err)
+	}
+	for _, fileState := range files {
+		fmt.Printf("%s  %12d  %s  %s\n", fileState.Checksum, fileState.Size, fileState.ModTime.Local().Format(time.RFC3339), fileState.Path)
+	}
+	log.Printf("%d %s files in %s", len(files), *status, stateManager.GetStatePath())
+}
+
+// 显示已保存状态中单个文件的状态
+func runStateShow(config Config, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: state show <path>")
+	}
+
+	// 备份期间状态数据库被独占打开，先获取运行锁以便立即报告冲突
+	runLock, err := AcquireRunLock(config, "state show")
+	if err != nil {
+		log.Fatalf("Cannot read the local state: %v", err)
+	}
+	defer runLock.Release()
+
+	stateManager := NewStateManager(config)
+	defer stateManager.Close()
+
+	fileState, err := stateManager.QueryFile(args[0])
+	if err != nil {
+		runLock.Fatalf("Failed to query local state: %v", err)
+	}
+	if fileState == nil {
+		runLock.Fatalf("%s is not in the local state", args[0])
+	}
+
+	data, _ := json.MarshalIndent(fileState, "", "  ")
+	fmt.Println(string(data))
+}
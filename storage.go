@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 存储后端类型
+const (
+	StorageBackendB2    = "b2"    // Backblaze B2（默认）
+	StorageBackendS3    = "s3"    // S3兼容存储（B2的S3接口、MinIO等）
+	StorageBackendLocal = "local" // 本地目录（如NAS挂载点）
+)
+
+// RemoteFile 远程文件信息，与具体存储后端无关
+type RemoteFile struct {
+	Path            string            // BACKUP_PREFIX 下的相对路径
+	ID              string            // 文件版本ID（后端不支持版本时为空）
+	Size            int64             // 文件大小
+	SHA1            string            // 内容SHA1，未知时为空
+	UploadTimestamp time.Time         // 上传时间
+	LastModified    time.Time         // 源文件修改时间，未记录时为零值
+	Info            map[string]string // 附加元数据
+	Latest          bool              // 是否为该路径当前可见的最新版本
+	Hidden          bool              // 是否为隐藏（删除）标记，只出现在 ListFileVersions 的结果中
+	Encrypted       bool              // 内容是否经过客户端加密（元数据中没有记录时下载后才能确定）
+
+	handle interface{} // 后端内部使用的对象引用
+}
+
+// Storage 存储后端接口
+type Storage interface {
+	// UploadFile 上传本地文件到 remotePath
+	UploadFile(localPath, remotePath, checksum string) error
+	// DeleteFile 永久删除远程文件的指定版本
+	DeleteFile(file *RemoteFile) error
+	// HideFile 隐藏远程文件（软删除），之前的版本仍可按时间点恢复
+	HideFile(file *RemoteFile) error
+	// GetFileList 获取 BACKUP_PREFIX 下的全部文件
+	GetFileList() (map[string]*RemoteFile, error)
+	// GetFileAttrs 读取单个文件的元数据
+	GetFileAttrs(remotePath string) (*RemoteFile, error)
+	// ListFiles 列出指定相对路径（文件或目录前缀）下的文件
+	ListFiles(remotePath string) (map[string]*RemoteFile, error)
+	// ListFilesAsOf 列出指定时间点时每个文件的有效版本
+	ListFilesAsOf(remotePath string, asOf time.Time) (map[string]*RemoteFile, error)
+	// ListFileVersions 列出指定相对路径下每个文件的所有版本（包括隐藏标记），按上传时间从新到旧排序
+	ListFileVersions(remotePath string) (map[string][]*RemoteFile, error)
+	// DownloadFile 下载文件到本地路径，返回下载内容的SHA1校验和
+	DownloadFile(file *RemoteFile, localPath string) (string, error)
+	// Close 释放存储后端资源
+	Close() error
+}
+
+// UploadOptions 包装存储（分块模式）通过存储后端上传内部对象时使用的选项
+type UploadOptions struct {
+	Force bool              // 跳过重复检测，总是上传
+	Info  map[string]string // 额外记录在对象元数据中的信息
+}
+
+// OptionUploader 支持按选项上传文件的存储后端
+type OptionUploader interface {
+	// UploadFileWithOptions 按选项上传本地文件到 remotePath
+	UploadFileWithOptions(localPath, remotePath, checksum string, opts UploadOptions) error
+}
+
+// NewStorage 根据配置创建存储后端实例
+func NewStorage(config Config) (Storage, error) {
+	encryptor, err := NewEncryptor(config)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := NewCompressor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var storage Storage
+	switch config.StorageBackend {
+	case StorageBackendB2, "":
+		storage, err = NewB2Storage(config, encryptor, compressor)
+	case StorageBackendS3:
+		storage, err = NewS3Storage(config, encryptor, compressor)
+	case StorageBackendLocal:
+		storage, err = NewLocalStorage(config, encryptor, compressor)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.StorageBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 口令加密的主密钥由仓库中保存的盐派生，盐对象还记录了启用加密的时间，需要按对象名存取
+	if blobs, ok := storage.(BlobStorage); ok {
+		err = encryptor.LoadRepositorySalt(config, blobs)
+	} else if encryptor != nil {
+		err = fmt.Errorf("storage backend %s does not support encryption", config.StorageBackend)
+	}
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	// 分块和打包模式下包装普通的存储后端
+	switch config.RepositoryMode {
+	case RepositoryModeChunked:
+		return NewChunkedStorage(config, storage, encryptor, compressor)
+	case RepositoryModePacked:
+		return NewPackedStorage(config, storage, encryptor, compressor)
+	}
+	return storage, nil
+}
+
+// 检查存储后端所需的配置是否完整
+func validateStorageConfig(config Config) error {
+	if config.EncryptionPassphrase != "" && config.EncryptionKeyFile != "" {
+		return fmt.Errorf("ENCRYPTION_PASSPHRASE and ENCRYPTION_KEY_FILE are mutually exclusive")
+	}
+	if config.EncryptFileNames && config.EncryptionPassphrase == "" && config.EncryptionKeyFile == "" {
+		return fmt.Errorf("ENCRYPT_FILE_NAMES requires ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE")
+	}
+	if _, err := NewCompressor(config); err != nil {
+		return err
+	}
+
+	switch config.RepositoryMode {
+	case "", RepositoryModeFiles:
+	case RepositoryModeChunked:
+		if prefixesOverlap(config.ChunkPrefix, config.BackupPrefix) {
+			return fmt.Errorf("CHUNK_PREFIX %q must not overlap BACKUP_PREFIX %q", config.ChunkPrefix, config.BackupPrefix)
+		}
+	case RepositoryModePacked:
+		if prefixesOverlap(config.PackPrefix, config.BackupPrefix) {
+			return fmt.Errorf("PACK_PREFIX %q must not overlap BACKUP_PREFIX %q", config.PackPrefix, config.BackupPrefix)
+		}
+		if config.PackMaxFileSizeKB <= 0 || config.PackTargetSizeMB <= 0 {
+			return fmt.Errorf("PACK_MAX_FILE_SIZE_KB and PACK_TARGET_SIZE_MB must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown REPOSITORY_MODE %q (files, chunked or packed)", config.RepositoryMode)
+	}
+
+	if prefixesOverlap(config.SnapshotPrefix, config.BackupPrefix) {
+		return fmt.Errorf("SNAPSHOT_PREFIX %q must not overlap BACKUP_PREFIX %q", config.SnapshotPrefix, config.BackupPrefix)
+	}
+	// 分块模式的垃圾回收会删除 CHUNK_PREFIX 下未被引用的对象，快照不能放在其中
+	if config.RepositoryMode == RepositoryModeChunked && prefixesOverlap(config.SnapshotPrefix, config.ChunkPrefix) {
+		return fmt.Errorf("SNAPSHOT_PREFIX %q must not overlap CHUNK_PREFIX %q", config.SnapshotPrefix, config.ChunkPrefix)
+	}
+
+	// 加密的盐对象不能被当作备份文件列出或被垃圾回收删除
+	if config.EncryptionPassphrase != "" || config.EncryptionKeyFile != "" {
+		if salt := repositorySaltName(config); strings.HasPrefix(salt, config.BackupPrefix) ||
+			(config.RepositoryMode == RepositoryModeChunked && strings.HasPrefix(salt, config.ChunkPrefix)) {
+			return fmt.Errorf("encryption salt object %q must not be under BACKUP_PREFIX or CHUNK_PREFIX", salt)
+		}
+	}
+
+	if config.RemoteLock {
+		if prefixesOverlap(config.LockPrefix, config.BackupPrefix) {
+			return fmt.Errorf("LOCK_PREFIX %q must not overlap BACKUP_PREFIX %q", config.LockPrefix, config.BackupPrefix)
+		}
+		if config.RepositoryMode == RepositoryModeChunked && prefixesOverlap(config.LockPrefix, config.ChunkPrefix) {
+			return fmt.Errorf("LOCK_PREFIX %q must not overlap CHUNK_PREFIX %q", config.LockPrefix, config.ChunkPrefix)
+		}
+	}
+
+	switch config.StorageBackend {
+	case StorageBackendB2, "":
+		if config.BucketName == "" || config.AccountID == "" || config.ApplicationKey == "" {
+			return fmt.Errorf("B2_BUCKET_NAME, B2_ACCOUNT_ID and B2_APPLICATION_KEY are required for the b2 backend")
+		}
+	case StorageBackendS3:
+		if config.S3Endpoint == "" || config.S3Bucket == "" || config.S3AccessKey == "" || config.S3SecretKey == "" {
+			return fmt.Errorf("S3_ENDPOINT, S3_BUCKET_NAME, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the s3 backend")
+		}
+	case StorageBackendLocal:
+		if config.LocalStorageDir == "" {
+			return fmt.Errorf("LOCAL_STORAGE_DIR is required for the local backend")
+		}
+	default:
+		return fmt.Errorf("unknown storage backend: %s", config.StorageBackend)
+	}
+	return nil
+}
+
+// 检查两个对象名前缀是否重叠（其中一个是另一个的前缀）
+func prefixesOverlap(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// 检查文件是否属于指定路径（完全匹配或位于该目录下），空路径匹配全部
+func matchesRemotePath(relPath, remotePath string) bool {
+	if remotePath == "" || relPath == remotePath {
+		return true
+	}
+	// 避免 "a" 匹配到 "ab"
+	return strings.HasPrefix(relPath, strings.TrimSuffix(remotePath, "/")+"/")
+}
+
+// 将列出的文件加入结果，同一路径出现多次时（如启用文件名加密前后各上传过一次）保留最新上传的
+func addListedFile(fileMap map[string]*RemoteFile, relPath string, file *RemoteFile) {
+	if existing, ok := fileMap[relPath]; ok && existing.UploadTimestamp.After(file.UploadTimestamp) {
+		return
+	}
+	fileMap[relPath] = file
+}
+
+// objectFormat 下载内容的格式，由对象元数据或对象的类型决定；
+// 不按内容开头的字节判断，用户文件可能恰好以加密或压缩头部的魔数开始
+type objectFormat struct {
+	encrypted  bool      // 内容经过客户端加密
+	compressed bool      // 解密后的内容以压缩头部开始
+	framed     bool      // 内部对象：明文总是以压缩头部开始，是否加密由头部判断
+	uploaded   time.Time // 上传时间，配置了密钥时只接受启用加密之前上传的未加密内容
+}
+
+// 内部对象（分块、包中的条目、包索引、快照、锁）的格式
+func blobFormat(uploaded time.Time) objectFormat {
+	return objectFormat{compressed: true, framed: true, uploaded: uploaded}
+}
+
+// 按对象元数据中记录的加密参数和压缩算法确定文件对象的格式，没有记录的对象原样存储
+func fileFormat(info map[string]string, uploaded time.Time) objectFormat {
+	return objectFormat{
+		encrypted:  info[encryptionInfoKey] != "",
+		compressed: info[compressionInfoKey] != "",
+		uploaded:   uploaded,
+	}
+}
+
+// 返回下载内容解密并解压后的原始内容，并报告内容是否经过加密
+func openDownload(encryptor *Encryptor, r io.Reader, format objectFormat) (io.ReadCloser, bool, error) {
+	if format.framed {
+		// 内部对象的明文以压缩头部开始，不会与加密头部混淆
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(len(encryptionMagic))
+		format.encrypted = string(magic) == encryptionMagic
+		r = br
+	}
+
+	decrypted, err := encryptor.DownloadReader(r, format.encrypted, format.uploaded)
+	if err != nil {
+		return nil, format.encrypted, err
+	}
+	if !format.compressed {
+		return io.NopCloser(decrypted), format.encrypted, nil
+	}
+	content, err := decompressReader(decrypted)
+	return content, format.encrypted, err
+}
+
+// 将下载的内容解密、解压后写入本地路径，返回原始内容的SHA1校验和以及内容是否经过加密
+func writeDownload(encryptor *Encryptor, r io.Reader, localPath string, format objectFormat) (string, bool, error) {
+	content, encrypted, err := openDownload(encryptor, r, format)
+	if err != nil {
+		return "", encrypted, err
+	}
+	defer content.Close()
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return "", encrypted, err
+	}
+
+	// 边写入边计算校验和
+	hash := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), content); err != nil {
+		out.Close()
+		return "", encrypted, err
+	}
+
+	if err := out.Close(); err != nil {
+		return "", encrypted, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), encrypted, nil
+}
+
+// 从按上传时间从新到旧排序的版本中找出指定时间点的有效版本
+// 该时间点文件尚未上传或已被删除时返回nil
+func versionAsOf(versions []*RemoteFile, asOf time.Time) *RemoteFile {
+	for _, file := range versions {
+		if file.UploadTimestamp.After(asOf) {
+			continue
+		}
+		if file.Hidden {
+			return nil
+		}
+		return file
+	}
+	return nil
+}
+
+// 将版本按上传时间从新到旧排序，上传时间相同时保持列表顺序
+func sortVersions(versions map[string][]*RemoteFile) {
+	for _, fileVersions := range versions {
+		sort.SliceStable(fileVersions, func(i, j int) bool {
+			return fileVersions[i].UploadTimestamp.After(fileVersions[j].UploadTimestamp)
+		})
+	}
+}
+
+// 大文件分片上传参数
+const (
+	defaultUploadChunkSize       = 100 * 1000 * 1000      // 默认分片大小，与blazer默认值一致
+	minUploadChunkSize           = 5 * 1000 * 1000        // B2/S3允许的最小分片
+	maxUploadChunkSize           = 5 * 1000 * 1000 * 1000 // B2/S3允许的最大分片
+	maxUploadParts               = 10000                  // 单个文件最多的分片数
+	defaultUploadPartConcurrency = 4                      // 默认每个文件并发上传的分片数
+)
+
+// 根据配置和文件大小计算分片大小和并发分片数
+// 未配置时使用默认值；文件过大时自动增大分片，保证分片数不超过上限
+func uploadPartSettings(config Config, size int64) (int, int) {
+	chunkSize := int64(defaultUploadChunkSize)
+	if config.UploadChunkSizeMB > 0 {
+		chunkSize = int64(config.UploadChunkSizeMB) * 1000 * 1000
+	}
+	if chunkSize < minUploadChunkSize {
+		chunkSize = minUploadChunkSize
+	}
+	if size > chunkSize*maxUploadParts {
+		chunkSize = (size + maxUploadParts - 1) / maxUploadParts
+	}
+	if chunkSize > maxUploadChunkSize {
+		chunkSize = maxUploadChunkSize
+	}
+
+	parts := uploadPartCount(size, int(chunkSize))
+	concurrency := config.UploadPartConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadPartConcurrency
+	}
+	// 小文件不需要多个分片并发
+	if concurrency > parts {
+		concurrency = parts
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return int(chunkSize), concurrency
+}
+
+// 计算文件按分片大小切分后的分片数
+func uploadPartCount(size int64, chunkSize int) int {
+	if size <= 0 {
+		return 1
+	}
+	return int((size + int64(chunkSize) - 1) / int64(chunkSize))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Uploader 并发上传器结构体，使用固定数量的工作协程上传变化的文件
+type Uploader struct {
+	config  Config
+	storage Storage
+	state   *LocalState
+	resumer *UploadResumer // 为空表示不续传
+
+	stateManager   *StateManager // 为空表示上传过程中不保存检查点
+	lastCheckpoint time.Time
+}
+
+// NewUploader 创建新的并发上传器实例
+func NewUploader(config Config, storage Storage, state *LocalState) *Uploader {
+	return &Uploader{
+		config:  config,
+		storage: storage,
+		state:   state,
+	}
+}
+
+// EnableResume 为支持续传的存储后端启用大文件续传
+func (u *Uploader) EnableResume(resumer *UploadResumer) {
+	resumable, ok := u.storage.(ResumableStorage)
+	if !ok {
+		return
+	}
+
+	u.resumer = resumer
+	resumable.SetUploadResumer(resumer)
+}
+
+// EnableCheckpoints 上传过程中每隔 STATE_CHECKPOINT_SECONDS 保存一次状态，
+// 运行被中断时已上传的文件不需要重新上传
+func (u *Uploader) EnableCheckpoints(stateManager *StateManager) {
+	if u.config.StateCheckpointSeconds <= 0 {
+		return
+	}
+
+	u.stateManager = stateManager
+	u.lastCheckpoint = time.Now()
+}
+
+// uploadJob 上传任务：单个文件，或打包上传的一组小文件
+type uploadJob struct {
+	file *FileState
+	pack []*FileState
+}
+
+// UploadFiles 并发上传文件，结果累加到 stats 的 uploaded/failed 计数中
+// 只有上传成功的文件才会被标记为已备份
+func (u *Uploader) UploadFiles(files []*FileState, stats map[string]int) {
+	u.abandonStaleUploads()
+
+	jobs := u.jobs(files)
+	workers := u.config.UploadConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	queue := make(chan uploadJob)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if job.pack != nil {
+					u.uploadPack(job.pack, stats)
+					continue
+				}
+
+				fileState := job.file
+				err := u.uploadFile(fileState)
+
+				// 状态可能正在被续传记录保存，需要持有状态锁
+				u.state.mu.Lock()
+				if err != nil {
+					log.Printf("Upload failed for %s: %v", fileState.Path, err)
+					stats["failed"]++
+				} else {
+					stats["uploaded"]++
+					fileState.BackedUp = true // 标记为已备份
+					u.state.markDirty(fileState.Path)
+					u.checkpoint()
+				}
+				u.state.mu.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// 将文件分为上传任务；支持打包的存储后端把小文件按目标大小分组
+func (u *Uploader) jobs(files []*FileState) []uploadJob {
+	packer, ok := u.storage.(PackingStorage)
+	if !ok {
+		jobs := make([]uploadJob, 0, len(files))
+		for _, fileState := range files {
+			jobs = append(jobs, uploadJob{file: fileState})
+		}
+		return jobs
+	}
+
+	var jobs []uploadJob
+	var pack []*FileState
+	var packSize int64
+	for _, fileState := range files {
+		if !packer.ShouldPack(fileState.Size) {
+			jobs = append(jobs, uploadJob{file: fileState})
+			continue
+		}
+
+		pack = append(pack, fileState)
+		packSize += fileState.Size
+		if packSize >= packer.PackTargetSize() {
+			jobs = append(jobs, uploadJob{pack: pack})
+			pack, packSize = nil, 0
+		}
+	}
+	if len(pack) > 0 {
+		jobs = append(jobs, uploadJob{pack: pack})
+	}
+	return jobs
+}
+
+// 打包上传一组小文件，包上传成功后其中的文件才被标记为已备份
+func (u *Uploader) uploadPack(files []*FileState, stats map[string]int) {
+	log.Printf("Packing %d small changed files", len(files))
+	packed, err := u.storage.(PackingStorage).UploadPack(files)
+
+	u.state.mu.Lock()
+	defer u.state.mu.Unlock()
+	if err != nil {
+		log.Printf("Pack upload failed for %d files: %v", len(files), err)
+		stats["failed"] += len(files)
+		return
+	}
+
+	stats["uploaded"] += len(packed)
+	stats["failed"] += len(files) - len(packed)
+	for _, fileState := range packed {
+		fileState.BackedUp = true
+		u.state.markDirty(fileState.Path)
+	}
+	u.checkpoint()
+}
+
+// 距离上次保存超过检查点间隔时保存状态（调用方需持有 state.mu）
+func (u *Uploader) checkpoint() {
+	interval := time.Duration(u.config.StateCheckpointSeconds) * time.Second
+	if u.stateManager == nil || time.Since(u.lastCheckpoint) < interval {
+		return
+	}
+
+	u.lastCheckpoint = time.Now()
+	if err := u.stateManager.writeState(u.state); err != nil {
+		log.Printf("Warning: Could not save state checkpoint: %v", err)
+		return
+	}
+	log.Printf("State checkpoint saved to %s", u.stateManager.GetStatePath())
+}
+
+// 取消超过最长续传时间的未完成大文件上传
+func (u *Uploader) abandonStaleUploads() {
+	if u.resumer == nil {
+		return
+	}
+
+	resumable := u.storage.(ResumableStorage)
+	for _, pending := range u.resumer.TakeStale() {
+		log.Printf("Abandoning stale unfinished upload of %s (started at %s)",
+			pending.Path, pending.StartedAt.Format(time.RFC3339))
+		if err := resumable.CancelUnfinishedUpload(pending.Path, pending.FileID); err != nil {
+			log.Printf("Warning: Could not cancel unfinished upload of %s: %v", pending.Path, err)
+		}
+	}
+}
+
+// 上传单个文件
+func (u *Uploader) uploadFile(fileState *FileState) error {
+	localPath := filepath.Join(u.config.SourceDir, fileState.Path)
+
+	log.Printf("Uploading changed file: %s", fileState.Path)
+	return u.storage.UploadFile(localPath, fileState.Path, fileState.Checksum)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 并发读取目录的协程数
+const scanWalkConcurrency = 8
+
+// parallelWalker 并发目录遍历器，同时读取多个目录以充分利用NVMe等高队列深度的存储
+// 固定数量的协程从待读取目录队列中取出目录，目录再多也不会创建更多的协程
+type parallelWalker struct {
+	concurrency int
+	fn          func(path string, info os.FileInfo) error
+	skipDir     func(path string) bool       // 返回 true 的目录不读取
+	onError     func(path string, err error) // 处理单个路径的读取错误
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []string // 待读取的目录
+	active int      // 正在读取的目录数
+	err    error    // fn 返回的第一个错误
+}
+
+// newParallelWalker 创建新的并发目录遍历器实例
+func newParallelWalker(concurrency int) *parallelWalker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	w := &parallelWalker{concurrency: concurrency}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Walk 遍历 root 下的所有普通文件，fn、skipDir 和 onError 会被多个协程并发调用，调用顺序不确定
+// skipDir 返回 true 的子目录及其下的全部内容被跳过（skipDir 为 nil 时不跳过）；
+// 与 filepath.Walk 一样不跟随符号链接目录，指向普通文件的符号链接按目标文件处理，FIFO、设备等其他类型的条目被跳过
+// 无法读取的子目录或条目交给 onError 处理后继续遍历；root 无法读取或 fn 返回错误时停止遍历并返回该错误
+func (w *parallelWalker) Walk(root string, fn func(path string, info os.FileInfo) error, skipDir func(path string) bool, onError func(path string, err error)) error {
+	w.fn = fn
+	w.skipDir = skipDir
+	w.onError = onError
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	w.visit(root, entries)
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	return w.err
+}
+
+// 从队列中取出目录读取，直到没有待读取的目录或出错
+func (w *parallelWalker) work() {
+	for {
+		dir, ok := w.next()
+		if !ok {
+			return
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			w.onError(dir, err)
+		} else {
+			w.visit(dir, entries)
+		}
+		w.finish()
+	}
+}
+
+// 取出下一个待读取的目录，队列为空时等待正在读取的目录加入子目录
+// 队列为空且没有正在读取的目录（遍历结束）或已经出错时返回 false
+func (w *parallelWalker) next() (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.queue) == 0 && w.active > 0 && w.err == nil {
+		w.cond.Wait()
+	}
+	if len(w.queue) == 0 || w.err != nil {
+		return "", false
+	}
+
+	// 后进先出，先深入遍历，队列长度不会随目录总数增长
+	dir := w.queue[len(w.queue)-1]
+	w.queue = w.queue[:len(w.queue)-1]
+	w.active++
+	return dir, true
+}
+
+// 目录读取完成
+func (w *parallelWalker) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active--
+	w.cond.Broadcast()
+}
+
+// 将子目录加入队列
+func (w *parallelWalker) push(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queue = append(w.queue, dir)
+	w.cond.Signal()
+}
+
+// 处理目录中的条目：子目录加入队列，普通文件交给 fn
+func (w *parallelWalker) visit(dir string, entries []os.DirEntry) {
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if w.skipDir == nil || !w.skipDir(path) {
+				w.push(path)
+			}
+			continue
+		}
+
+		var info os.FileInfo
+		var err error
+		switch {
+		case entry.Type().IsRegular():
+			info, err = entry.Info()
+		case entry.Type()&os.ModeSymlink != 0:
+			info, err = os.Stat(path)
+		default:
+			log.Printf("Skipping %s: not a regular file (%v)", path, entry.Type())
+			continue
+		}
+		if err != nil {
+			w.onError(path, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			log.Printf("Skipping %s: symbolic link to a non-regular file", path)
+			continue
+		}
+
+		if err := w.fn(path, info); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// 记录第一个错误，唤醒等待中的协程结束遍历
+func (w *parallelWalker) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.cond.Broadcast()
+}
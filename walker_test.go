@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 遍历返回普通文件和指向普通文件的符号链接，跳过排除的目录，不跟随符号链接目录
+func TestParallelWalker(t *testing.T) {
+	root := t.TempDir()
+	var want []string
+	for i := 0; i < 50; i++ {
+		relPath := filepath.Join("d"+strings.Repeat("x", i%5), "sub", string(rune('a'+i%26))+".txt")
+		writeTestFile(t, root, filepath.ToSlash(relPath), "data")
+	}
+	writeTestFile(t, root, "skip/inner/file.txt", "excluded")
+	writeTestFile(t, root, "top.txt", "top")
+	if err := os.Symlink(filepath.Join(root, "top.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "skip"), filepath.Join(root, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && !strings.Contains(path, "skip") {
+			relPath, _ := filepath.Rel(root, path)
+			want = append(want, relPath)
+		}
+		return nil
+	})
+	want = append(want, "link.txt")
+	sort.Strings(want)
+
+	var mu sync.Mutex
+	var got []string
+	err := newParallelWalker(4).Walk(root, func(path string, info os.FileInfo) error {
+		relPath, _ := filepath.Rel(root, path)
+		mu.Lock()
+		got = append(got, relPath)
+		mu.Unlock()
+		return nil
+	}, func(dir string) bool {
+		return filepath.Base(dir) == "skip"
+	}, func(path string, err error) {
+		t.Errorf("unexpected error for %s: %v", path, err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("walked %v, want %v", got, want)
+	}
+}